@@ -0,0 +1,272 @@
+package moresql
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rwynn/gtm"
+)
+
+const (
+	workerIdle     = "idle"
+	workerApplying = "applying"
+	workerPaused   = "paused"
+)
+
+// admin is the admin API of this process, the tailer attaches itself when serving
+var admin = &Admin{}
+
+// CheckpointStatus is the oplog position of a checkpoint
+type CheckpointStatus struct {
+	Epoch       int64     `json:"epoch"`
+	Increment   int64     `json:"increment"`
+	ResumeToken string    `json:"resume_token,omitempty"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+func newCheckpointStatus(m MoresqlMetadata) *CheckpointStatus {
+	epoch, increment := gtm.ParseTimestamp(m.Position())
+	return &CheckpointStatus{Epoch: int64(epoch), Increment: int64(increment), ResumeToken: m.ResumeToken.String, ProcessedAt: m.ProcessedAt}
+}
+
+// TailerStatus is the state of the tailer returned by /admin/status
+type TailerStatus struct {
+	Paused bool `json:"paused"`
+	// Checkpoint is the position every op has been applied up to,
+	// nil before the first op is read
+	Checkpoint *CheckpointStatus `json:"checkpoint"`
+	// Pending is the number of ops read but not yet applied
+	Pending int               `json:"pending"`
+	Backlog map[string]int    `json:"backlog"`
+	Workers map[string]int    `json:"workers"`
+	Busy    map[string]string `json:"busy"`
+}
+
+// TailerControl is the part of Tailer driven by the admin API
+type TailerControl interface {
+	Pause()
+	Resume()
+	Status() TailerStatus
+	// SaveCheckpointNow persists the current checkpoint, returning it
+	SaveCheckpointNow() (*CheckpointStatus, error)
+}
+
+// Admin serves /admin/status, /admin/pause, /admin/resume and /admin/checkpoint
+type Admin struct {
+	sync.Mutex
+	control TailerControl
+}
+
+// Control sets the tailer driven by the API
+func (a *Admin) Control(c TailerControl) {
+	a.Lock()
+	a.control = c
+	a.Unlock()
+}
+
+func (a *Admin) controlled() TailerControl {
+	a.Lock()
+	defer a.Unlock()
+	return a.control
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// Handler serves the API to requests bearing token, ie
+// Authorization: Bearer <token>
+func (a *Admin) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	post := func(path string, fn func(TailerControl) (interface{}, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				adminError(w, http.StatusMethodNotAllowed, "use POST")
+				return
+			}
+			c := a.controlled()
+			if c == nil {
+				adminError(w, http.StatusServiceUnavailable, "not tailing")
+				return
+			}
+			v, err := fn(c)
+			if err != nil {
+				adminError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, v)
+		})
+	}
+	mux.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {
+		c := a.controlled()
+		if c == nil {
+			adminError(w, http.StatusServiceUnavailable, "not tailing")
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Status())
+	})
+	post("/admin/pause", func(c TailerControl) (interface{}, error) {
+		c.Pause()
+		return c.Status(), nil
+	})
+	post("/admin/resume", func(c TailerControl) (interface{}, error) {
+		c.Resume()
+		return c.Status(), nil
+	})
+	post("/admin/checkpoint", func(c TailerControl) (interface{}, error) {
+		return c.SaveCheckpointNow()
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			adminError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// pauseGate holds workers while applying ops is paused
+type pauseGate struct {
+	sync.Mutex
+	resume chan struct{}
+	closed bool
+}
+
+// Pause is false once the gate is closed
+func (g *pauseGate) Pause() bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.closed {
+		return false
+	}
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+	}
+	return true
+}
+
+func (g *pauseGate) Resume() {
+	g.Lock()
+	defer g.Unlock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+	}
+}
+
+// Close resumes and ignores later pauses, returning whether it was paused
+func (g *pauseGate) Close() bool {
+	g.Lock()
+	defer g.Unlock()
+	g.closed = true
+	if g.resume == nil {
+		return false
+	}
+	close(g.resume)
+	g.resume = nil
+	return true
+}
+
+func (g *pauseGate) Paused() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.resume != nil
+}
+
+// Wait blocks while paused
+func (g *pauseGate) Wait() {
+	g.Lock()
+	resume := g.resume
+	g.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
+// workerStates tracks what each tail worker is doing
+type workerStates struct {
+	sync.Mutex
+	states map[string]string
+}
+
+func newWorkerStates() *workerStates {
+	return &workerStates{states: make(map[string]string)}
+}
+
+func (s *workerStates) Set(id string, state string) {
+	s.Lock()
+	s.states[id] = state
+	s.Unlock()
+}
+
+// Summary counts workers by state and lists those which are not idle
+func (s *workerStates) Summary() (map[string]int, map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	counts := make(map[string]int)
+	busy := make(map[string]string)
+	for id, state := range s.states {
+		counts[state]++
+		if state != workerIdle {
+			busy[id] = state
+		}
+	}
+	return counts, busy
+}
+
+// Pause stops workers applying ops. Reading continues until the per collection
+// channels are full, after which the Mongo cursor is no longer read.
+func (t *Tailer) Pause() {
+	if !t.gate.Pause() {
+		log.Warn("Not pausing while shutting down")
+		return
+	}
+	log.Info("Paused applying ops")
+}
+
+func (t *Tailer) Resume() {
+	t.gate.Resume()
+	log.Info("Resumed applying ops")
+}
+
+// await blocks worker id while paused
+func (t *Tailer) await(id string) {
+	if t.gate.Paused() {
+		t.workers.Set(id, workerPaused)
+		t.gate.Wait()
+	}
+	t.workers.Set(id, workerApplying)
+}
+
+func (t *Tailer) Status() TailerStatus {
+	s := TailerStatus{Paused: t.gate.Paused(), Pending: t.watermark.Pending(), Backlog: t.Backlog()}
+	if latest, ok := t.watermark.Low(); ok {
+		s.Checkpoint = newCheckpointStatus(latest)
+	}
+	s.Workers, s.Busy = t.workers.Summary()
+	return s
+}
+
+func (t *Tailer) SaveCheckpointNow() (*CheckpointStatus, error) {
+	latest, ok := t.watermark.Low()
+	if !ok {
+		return nil, fmt.Errorf("no ops have been read yet")
+	}
+	if err := t.SaveCheckpoint(latest); err != nil {
+		return nil, err
+	}
+	return newCheckpointStatus(latest), nil
+}
@@ -0,0 +1,88 @@
+package moresql_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+type fakeControl struct {
+	paused bool
+	err    error
+}
+
+func (f *fakeControl) Pause()  { f.paused = true }
+func (f *fakeControl) Resume() { f.paused = false }
+func (f *fakeControl) Status() m.TailerStatus {
+	return m.TailerStatus{Paused: f.paused, Backlog: map[string]int{"app.users": 2}}
+}
+func (f *fakeControl) SaveCheckpointNow() (*m.CheckpointStatus, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &m.CheckpointStatus{Epoch: 1485144398, Increment: 2}, nil
+}
+
+func adminRequest(h http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *MySuite) TestAdminRequiresToken(c *C) {
+	a := &m.Admin{}
+	a.Control(&fakeControl{})
+	h := a.Handler("secret")
+	c.Check(adminRequest(h, "GET", "/admin/status", "").Code, Equals, http.StatusUnauthorized)
+	c.Check(adminRequest(h, "GET", "/admin/status", "wrong").Code, Equals, http.StatusUnauthorized)
+	c.Check(adminRequest(h, "GET", "/admin/status", "secret").Code, Equals, http.StatusOK)
+}
+
+func (s *MySuite) TestAdminNotTailing(c *C) {
+	h := (&m.Admin{}).Handler("secret")
+	c.Check(adminRequest(h, "GET", "/admin/status", "secret").Code, Equals, http.StatusServiceUnavailable)
+	c.Check(adminRequest(h, "POST", "/admin/pause", "secret").Code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *MySuite) TestAdminPauseResume(c *C) {
+	a := &m.Admin{}
+	f := &fakeControl{}
+	a.Control(f)
+	h := a.Handler("secret")
+	c.Check(adminRequest(h, "GET", "/admin/pause", "secret").Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(f.paused, Equals, false)
+
+	rec := adminRequest(h, "POST", "/admin/pause", "secret")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(f.paused, Equals, true)
+	var status m.TailerStatus
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &status), IsNil)
+	c.Check(status.Paused, Equals, true)
+	c.Check(status.Backlog["app.users"], Equals, 2)
+
+	c.Check(adminRequest(h, "POST", "/admin/resume", "secret").Code, Equals, http.StatusOK)
+	c.Check(f.paused, Equals, false)
+}
+
+func (s *MySuite) TestAdminCheckpoint(c *C) {
+	a := &m.Admin{}
+	f := &fakeControl{}
+	a.Control(f)
+	h := a.Handler("secret")
+	rec := adminRequest(h, "POST", "/admin/checkpoint", "secret")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	var checkpoint m.CheckpointStatus
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &checkpoint), IsNil)
+	c.Check(checkpoint.Epoch, Equals, int64(1485144398))
+
+	f.err = errors.New("connection refused")
+	c.Check(adminRequest(h, "POST", "/admin/checkpoint", "secret").Code, Equals, http.StatusInternalServerError)
+}
@@ -0,0 +1,121 @@
+package moresql
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rwynn/gtm"
+)
+
+// CollapseOps reduces ops to the final operation for each namespace and _id,
+// keeping the position of the first occurrence. Upserts carry the full document
+// so only the most recent operation on a given _id needs to be applied.
+func CollapseOps(ops []*gtm.Op) []*gtm.Op {
+	positions := make(map[string]int)
+	var collapsed []*gtm.Op
+	for _, op := range ops {
+		key := fmt.Sprintf("%s.%v", op.Namespace, op.Id)
+		if i, ok := positions[key]; ok {
+			collapsed[i] = op
+			continue
+		}
+		positions[key] = len(collapsed)
+		collapsed = append(collapsed, op)
+	}
+	return collapsed
+}
+
+// batchConsumer accumulates ops until batchSize or batchDuration is reached
+// then applies them as a single Batch. Ops arrive through consistentBroker
+// so each _id is always handled by the same batchConsumer in oplog order.
+func (t *Tailer) batchConsumer(id string, in <-chan *gtm.Op) {
+	ticker := time.NewTicker(t.env.batchDuration)
+	defer ticker.Stop()
+	var pending []*gtm.Op
+	for {
+		t.workers.Set(id, workerIdle)
+		select {
+		case op := <-in:
+			pending = append(pending, op)
+			if len(pending) < t.env.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+		}
+		t.await(id)
+		t.processBatch(id, pending)
+		pending = nil
+	}
+}
+
+func (t *Tailer) processBatch(id string, ops []*gtm.Op) {
+	var actionable []*gtm.Op
+	for _, op := range ops {
+		// Dropped before collapsing so an insert followed by
+		// a disallowed delete still results in the insert
+		if op.IsDelete() && !t.env.allowDeletes {
+			continue
+		}
+		if IsInsertUpdateDelete(op) {
+			actionable = append(actionable, op)
+		}
+	}
+	batch := Batch{}
+	collapsed := CollapseOps(actionable)
+	for _, op := range collapsed {
+		c := t.config[op.GetDatabase()].Collections[op.GetCollection()]
+		batch.Ops = append(batch.Ops, NewSinkOp(c, op))
+		switch {
+		case op.IsInsert():
+			t.counters.insert.Incr(1)
+			metrics.Op(op.Namespace, "insert")
+		case op.IsUpdate():
+			t.counters.update.Incr(1)
+			metrics.Op(op.Namespace, "update")
+		case op.IsDelete():
+			t.counters.delete.Incr(1)
+			metrics.Op(op.Namespace, "delete")
+		}
+		ts, _ := gtm.ParseTimestamp(op.Timestamp)
+		metrics.Lag(t.MsLag(ts, time.Now))
+	}
+	if t.env.checkpoint {
+		// Written in the same transaction as the data, so a crash
+		// either loses both or neither
+		if m, ok := t.watermark.LowWith(ops); ok {
+			batch.Checkpoint = &m
+		}
+	}
+	var err error
+	if len(batch.Ops) > 0 || batch.Checkpoint != nil {
+		err = t.backoff.Retry(func() error { return t.sink.Write(batch) })
+	}
+	log.WithFields(log.Fields{
+		"worker":    id,
+		"ops":       len(ops),
+		"collapsed": len(batch.Ops),
+		"error":     err,
+	}).Debug("Batch worker processed")
+	if err == nil && batch.Checkpoint != nil {
+		metrics.CheckpointSaved()
+	}
+	if IsTransientError(err) {
+		// Writing ops individually would fail the same way. None are
+		// marked done so they are replayed from the last checkpoint.
+		log.WithFields(log.Fields{"worker": id, "error": err}).Fatal("Unable to apply batch, exiting to resume from the last checkpoint")
+	}
+	if err != nil {
+		// Fall back to individual writes so that a single bad
+		// record does not prevent the rest of the batch applying.
+		// The checkpoint is then left to the periodic Checkpoints.
+		log.Warnf("Batch write failed, applying ops individually: %s", err.Error())
+		for i, op := range batch.Ops {
+			t.write(collapsed[i], op)
+		}
+	}
+	t.watermark.Done(ops...)
+}
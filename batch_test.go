@@ -0,0 +1,28 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestCollapseOps(c *C) {
+	insertA := &gtm.Op{Id: "a", Namespace: "db.users", Operation: "i"}
+	insertB := &gtm.Op{Id: "b", Namespace: "db.users", Operation: "i"}
+	updateA := &gtm.Op{Id: "a", Namespace: "db.users", Operation: "u"}
+	deleteB := &gtm.Op{Id: "b", Namespace: "db.users", Operation: "d"}
+	otherA := &gtm.Op{Id: "a", Namespace: "db.accounts", Operation: "i"}
+	var table = []struct {
+		ops      []*gtm.Op
+		expected []*gtm.Op
+	}{
+		{[]*gtm.Op{}, nil},
+		{[]*gtm.Op{insertA, insertB}, []*gtm.Op{insertA, insertB}},
+		{[]*gtm.Op{insertA, insertB, updateA}, []*gtm.Op{updateA, insertB}},
+		{[]*gtm.Op{insertA, insertB, deleteB, updateA}, []*gtm.Op{updateA, deleteB}},
+		{[]*gtm.Op{insertA, otherA}, []*gtm.Op{insertA, otherA}},
+	}
+	for _, t := range table {
+		c.Check(m.CollapseOps(t.ops), DeepEquals, t.expected)
+	}
+}
@@ -0,0 +1,95 @@
+package moresql
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OplogWindow returns the timestamps of the oldest and newest entries in the oplog
+func OplogWindow(session *mgo.Session) (first bson.MongoTimestamp, last bson.MongoTimestamp, err error) {
+	options := gtm.DefaultOptions()
+	options.Fill(session)
+	oplog := gtm.OpLogCollection(session, options)
+	var entry gtm.OpLog
+	if err = oplog.Find(nil).Sort("$natural").One(&entry); err != nil {
+		return
+	}
+	first = entry.Timestamp
+	if err = oplog.Find(nil).Sort("-$natural").One(&entry); err != nil {
+		return
+	}
+	last = entry.Timestamp
+	return
+}
+
+// OplogCovers reports whether ops after position are all still in an oplog
+// whose oldest entry is first
+func OplogCovers(first bson.MongoTimestamp, position bson.MongoTimestamp) bool {
+	return first <= position
+}
+
+// BootstrapResumes reports whether a bootstrap continues an interrupted full
+// sync. Rows already copied are only consistent with the oplog position saved
+// when that sync began, which requires -checkpoint.
+func BootstrapResumes(checkpoint bool, inProgress bool, position bson.MongoTimestamp) bool {
+	return checkpoint && inProgress && position != 0
+}
+
+// Bootstrap records the current oplog position, runs a full sync and then
+// tails from the recorded position. Ops which happened during the full sync
+// are applied after it, so they win over the snapshot rows for the same _id.
+func Bootstrap(config Config, pg *sqlx.DB, session *mgo.Session, env Env) {
+	first, last, err := OplogWindow(session)
+	if err != nil {
+		log.Fatalf("Unable to read the oplog, -bootstrap requires access to local.oplog.rs: %s", err.Error())
+	}
+	start := last
+	resume := false
+	if env.checkpoint {
+		metadata := FetchMetadata(env.checkpoint, pg, env.appName, env.metadataSchema)
+		progress, err := newSyncProgressStore(pg, env)
+		if err != nil {
+			log.Errorf("Unable to load full sync progress: %s", err)
+		}
+		resume = BootstrapResumes(env.checkpoint, progress.InProgress(), metadata.Position())
+		if resume {
+			start = metadata.Position()
+			log.Info("Resuming interrupted bootstrap")
+		} else {
+			epoch, _ := gtm.ParseTimestamp(start)
+			m := MoresqlMetadata{AppName: env.appName, LastEpoch: int64(epoch), LastTimestamp: int64(start), ProcessedAt: time.Now()}
+			if err := NewPostgresSink(pg, env.metadataSchema).Checkpoint(m); err != nil {
+				log.Errorf("Unable to save bootstrap position into moresql_metadata: %s", err.Error())
+			}
+		}
+	}
+	epoch, increment := gtm.ParseTimestamp(start)
+	log.WithFields(log.Fields{
+		"epoch":     epoch,
+		"increment": increment,
+	}).Info("Bootstrap starting full sync, tail will start from this oplog position")
+	if !OplogCovers(first, start) {
+		log.Fatalf("Oplog no longer contains the bootstrap position, run -bootstrap again without -checkpoint or with a larger oplog")
+	}
+
+	// Progress left by an earlier run would skip documents changed before
+	// the new position, so the full sync starts over
+	env.fullSyncRestart = !resume
+	FullSync(config, pg, session, env)
+
+	first, _, err = OplogWindow(session)
+	if err != nil {
+		log.Fatalf("Unable to read the oplog after full sync: %s", err.Error())
+	}
+	if !OplogCovers(first, start) {
+		log.Fatalf("Oplog rolled over during full sync so ops since it began have been lost. Increase the oplog size or use -full-sync-collections and run -bootstrap again")
+	}
+	log.Info("Bootstrap full sync complete, tailing from its starting position")
+	env.replayTimestamp = start
+	Tail(config, pg, session, env)
+}
@@ -0,0 +1,25 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *MySuite) TestOplogCovers(c *C) {
+	position := bson.MongoTimestamp(1485144398<<32 | 5)
+	c.Check(m.OplogCovers(position-1, position), Equals, true)
+	c.Check(m.OplogCovers(position, position), Equals, true)
+	// The oplog rolled over past position
+	c.Check(m.OplogCovers(position+1, position), Equals, false)
+}
+
+func (s *MySuite) TestBootstrapResumes(c *C) {
+	position := bson.MongoTimestamp(1485144398<<32 | 5)
+	c.Check(m.BootstrapResumes(true, true, position), Equals, true)
+	// Without -checkpoint the position the copied rows match is unknown
+	c.Check(m.BootstrapResumes(false, true, position), Equals, false)
+	c.Check(m.BootstrapResumes(true, true, 0), Equals, false)
+	// A finished or absent full sync is started over
+	c.Check(m.BootstrapResumes(true, false, position), Equals, false)
+}
@@ -0,0 +1,200 @@
+package moresql
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mongo types recognized in Fields.Mongo.Type. Other types are passed
+// through as extracted from the document.
+const (
+	mongoTypeId        = "id"
+	mongoTypeObjectId  = "objectid"
+	mongoTypeDate      = "date"
+	mongoTypeDecimal   = "decimal"
+	mongoTypeUUID      = "uuid"
+	mongoTypeBinary    = "binary"
+	mongoTypeTimestamp = "timestamp"
+	mongoTypeRegex     = "regex"
+)
+
+// bsonUUIDKinds are the binary subtypes holding a UUID, 3 is the legacy form
+var bsonUUIDKinds = map[byte]bool{0x03: true, 0x04: true}
+
+// FormatUUID renders 16 bytes in the canonical 8-4-4-4-12 form
+func FormatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return strings.Join([]string{h[0:8], h[8:12], h[12:16], h[16:20], h[20:32]}, "-")
+}
+
+func parseUUID(s string) ([]byte, bool) {
+	h := strings.Replace(s, "-", "", -1)
+	if len(h) != 32 || len(s) != 36 {
+		return nil, false
+	}
+	b, err := hex.DecodeString(h)
+	return b, err == nil
+}
+
+func formatRegex(r bson.RegEx) string {
+	return "/" + r.Pattern + "/" + r.Options
+}
+
+func mongoTimestampTime(ts bson.MongoTimestamp) time.Time {
+	return time.Unix(int64(ts>>32), 0).UTC()
+}
+
+// NormalizeBSON converts BSON specific values within v, at any depth, into
+// values that encode to meaningful JSON: ObjectIds become hex strings, UUIDs
+// their canonical form, Decimal128 an exact JSON number and timestamps times.
+// Other binary data becomes base64 and regular expressions /pattern/options.
+func NormalizeBSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.ObjectId:
+		return hex.EncodeToString([]byte(t))
+	case bson.Decimal128:
+		n := json.Number(t.String())
+		// NaN and Inf are not JSON numbers
+		if _, err := json.Marshal(n); err != nil {
+			return t.String()
+		}
+		return n
+	case bson.Binary:
+		if bsonUUIDKinds[t.Kind] && len(t.Data) == 16 {
+			return FormatUUID(t.Data)
+		}
+		return t.Data
+	case bson.MongoTimestamp:
+		return mongoTimestampTime(t)
+	case time.Time:
+		return t.UTC()
+	case bson.RegEx:
+		return formatRegex(t)
+	case bson.Symbol:
+		return string(t)
+	case bson.JavaScript:
+		return t.Code
+	case bson.M:
+		return NormalizeBSON(map[string]interface{}(t))
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = NormalizeBSON(e)
+		}
+		return out
+	case bson.D:
+		out := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			out[e.Name] = NormalizeBSON(e.Value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = NormalizeBSON(e)
+		}
+		return out
+	}
+	return v
+}
+
+// ConvertMongoType converts a value extracted from a normalized document
+// into the Go type lib/pq expects for a field of mongoType. Values which
+// cannot be converted are returned unchanged for Postgres to accept or reject.
+func ConvertMongoType(mongoType string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	converted, err := convertMongoType(strings.ToLower(mongoType), v)
+	if err != nil {
+		log.WithFields(log.Fields{"type": mongoType, "value": v, "error": err}).Debug("Unable to convert value")
+		return v
+	}
+	return converted
+}
+
+func convertMongoType(mongoType string, v interface{}) (interface{}, error) {
+	switch mongoType {
+	case mongoTypeId, mongoTypeObjectId:
+		if id, ok := v.(bson.ObjectId); ok {
+			return hex.EncodeToString([]byte(id)), nil
+		}
+	case mongoTypeDate:
+		switch t := v.(type) {
+		case time.Time:
+			return t.UTC(), nil
+		case string:
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			return ts.UTC(), err
+		case float64:
+			// Milliseconds since the epoch
+			return time.Unix(0, int64(t)*int64(time.Millisecond)).UTC(), nil
+		case int64:
+			return time.Unix(0, t*int64(time.Millisecond)).UTC(), nil
+		}
+	case mongoTypeTimestamp:
+		switch t := v.(type) {
+		case bson.MongoTimestamp:
+			return mongoTimestampTime(t), nil
+		case time.Time:
+			return t.UTC(), nil
+		case string:
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			return ts.UTC(), err
+		}
+	case mongoTypeDecimal:
+		switch t := v.(type) {
+		case json.Number:
+			return t.String(), nil
+		case bson.Decimal128:
+			return t.String(), nil
+		case float64:
+			return fmt.Sprint(t), nil
+		}
+	case mongoTypeUUID:
+		switch t := v.(type) {
+		case string:
+			if _, ok := parseUUID(t); ok {
+				return t, nil
+			}
+			// Binary of other subtypes is normalized to base64
+			b, err := base64.StdEncoding.DecodeString(t)
+			if err != nil || len(b) != 16 {
+				return nil, fmt.Errorf("%s is not a uuid", t)
+			}
+			return FormatUUID(b), nil
+		case bson.Binary:
+			if len(t.Data) == 16 {
+				return FormatUUID(t.Data), nil
+			}
+			return nil, fmt.Errorf("binary of %d bytes is not a uuid", len(t.Data))
+		case []byte:
+			if len(t) == 16 {
+				return FormatUUID(t), nil
+			}
+			return nil, fmt.Errorf("binary of %d bytes is not a uuid", len(t))
+		}
+	case mongoTypeBinary:
+		switch t := v.(type) {
+		case bson.Binary:
+			return t.Data, nil
+		case string:
+			if b, ok := parseUUID(t); ok {
+				return b, nil
+			}
+			return base64.StdEncoding.DecodeString(t)
+		}
+	case mongoTypeRegex:
+		if r, ok := v.(bson.RegEx); ok {
+			return formatRegex(r), nil
+		}
+	}
+	return v, nil
+}
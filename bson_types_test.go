@@ -0,0 +1,82 @@
+package moresql_test
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const uuidString = "01234567-89ab-cdef-0123-456789abcdef"
+
+func uuidBytes() []byte {
+	return []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+}
+
+func (s *MySuite) TestNormalizeBSON(c *C) {
+	id := bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1")
+	decimal, err := bson.ParseDecimal128("12345678901234567890.123456789")
+	c.Assert(err, IsNil)
+	est := time.FixedZone("EST", -5*3600)
+	doc := bson.M{
+		"owner":   id,
+		"price":   decimal,
+		"token":   bson.Binary{Kind: 0x04, Data: uuidBytes()},
+		"blob":    bson.Binary{Kind: 0x00, Data: []byte("hi")},
+		"created": time.Date(2017, 4, 5, 18, 30, 0, 0, est),
+		"ts":      bson.MongoTimestamp(1491417000 << 32),
+		"pattern": bson.RegEx{Pattern: "^a", Options: "i"},
+		"tags":    []interface{}{bson.D{{Name: "by", Value: id}}},
+	}
+	b, err := json.Marshal(m.NormalizeBSON(doc))
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, `{"blob":"aGk=","created":"2017-04-05T23:30:00Z","owner":"58e52d2d6c5bd6a8f1c8a7a1","pattern":"/^a/i","price":12345678901234567890.123456789,"tags":[{"by":"58e52d2d6c5bd6a8f1c8a7a1"}],"token":"`+uuidString+`","ts":"2017-04-05T18:30:00Z"}`)
+}
+
+func (s *MySuite) TestConvertMongoType(c *C) {
+	created := time.Date(2017, 4, 5, 23, 30, 0, 0, time.UTC)
+	c.Check(m.ConvertMongoType("objectid", bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1")), Equals, "58e52d2d6c5bd6a8f1c8a7a1")
+	c.Check(m.ConvertMongoType("date", "2017-04-05T23:30:00Z"), DeepEquals, created)
+	c.Check(m.ConvertMongoType("date", float64(1491435000000)), DeepEquals, created)
+	c.Check(m.ConvertMongoType("Date", "not a date"), Equals, "not a date")
+	c.Check(m.ConvertMongoType("timestamp", bson.MongoTimestamp(1491435000<<32|7)), DeepEquals, created)
+	c.Check(m.ConvertMongoType("decimal", json.Number("12345678901234567890.1")), Equals, "12345678901234567890.1")
+	c.Check(m.ConvertMongoType("uuid", uuidString), Equals, uuidString)
+	c.Check(m.ConvertMongoType("uuid", "ASNFZ4mrze8BI0VniavN7w=="), Equals, uuidString)
+	c.Check(m.ConvertMongoType("binary", uuidString), DeepEquals, uuidBytes())
+	c.Check(m.ConvertMongoType("binary", "aGk="), DeepEquals, []byte("hi"))
+	c.Check(m.ConvertMongoType("regex", bson.RegEx{Pattern: "^a", Options: "i"}), Equals, "/^a/i")
+	c.Check(m.ConvertMongoType("text", 42.0), Equals, 42.0)
+	c.Check(m.ConvertMongoType("date", nil), IsNil)
+}
+
+func (s *MySuite) TestSanitizeDataConvertsMongoTypes(c *C) {
+	id := bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1")
+	decimal, err := bson.ParseDecimal128("12345678901234567890.123456789")
+	c.Assert(err, IsNil)
+	fields, err := m.JsonToFields(`{
+		"_id": "objectid",
+		"price": "decimal",
+		"token": "uuid",
+		"created": {"mongo": {"name": "created", "type": "date"}, "postgres": {"name": "created", "type": "timestamptz"}},
+		"meta": {"mongo": {"name": "meta", "type": "object"}, "postgres": {"name": "meta", "type": "jsonb"}}
+	}`)
+	c.Assert(err, IsNil)
+	op := &gtm.Op{Id: id, Operation: "i", Data: map[string]interface{}{
+		"_id":     id,
+		"price":   decimal,
+		"token":   bson.Binary{Kind: 0x04, Data: uuidBytes()},
+		"created": time.Date(2017, 4, 5, 23, 30, 0, 0, time.UTC),
+		"meta":    bson.M{"owner": id, "big": int64(9007199254740993)},
+	}}
+	c.Check(m.SanitizeData(fields, op), DeepEquals, map[string]interface{}{
+		"_id":     "58e52d2d6c5bd6a8f1c8a7a1",
+		"price":   "12345678901234567890.123456789",
+		"token":   uuidString,
+		"created": time.Date(2017, 4, 5, 23, 30, 0, 0, time.UTC),
+		"meta":    `{"big":9007199254740993,"owner":"58e52d2d6c5bd6a8f1c8a7a1"}`,
+	})
+}
@@ -0,0 +1,162 @@
+package moresql
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/orcaman/concurrent-map"
+	"github.com/rwynn/gtm"
+)
+
+// bulkCopyChunkSize is the most rows loaded by a single COPY and merge
+const bulkCopyChunkSize = 5000
+
+// bulkCopyFlushFrequency bounds how long rows wait for a chunk to fill.
+// Full sync waits for rows to be written before saving its progress.
+const bulkCopyFlushFrequency = time.Duration(1) * time.Second
+
+// BulkLoader is implemented by sinks able to load many rows at once
+// faster than individual upserts, used by -full-sync -bulk-copy
+type BulkLoader interface {
+	BulkLoad(c Collection, rows []map[string]interface{}) error
+}
+
+// CollapseRows keeps the last of the sanitized rows sharing an id, in the
+// position of the first. Documents read later hold the newer data.
+func CollapseRows(c Collection, rows []map[string]interface{}) []map[string]interface{} {
+	o := Statement{c}
+	id := o.id().Postgres.Name
+	positions := make(map[string]int)
+	var collapsed []map[string]interface{}
+	for _, row := range rows {
+		key := fmt.Sprintf("%v", row[id])
+		if i, ok := positions[key]; ok {
+			collapsed[i] = row
+			continue
+		}
+		positions[key] = len(collapsed)
+		collapsed = append(collapsed, row)
+	}
+	return collapsed
+}
+
+// BulkLoad streams rows into a staging table with COPY then merges them
+// into the target with a single upsert, all in one transaction
+func (p *PostgresSink) BulkLoad(c Collection, rows []map[string]interface{}) error {
+	defer metrics.SQL("copy", time.Now())
+	o := Statement{c}
+	rows = CollapseRows(c, rows)
+	tx, err := p.pg.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(o.BuildCreateStaging()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(stagingTable, o.postgresFields()...))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err = stmt.Exec(o.BatchUpsertArgs([]map[string]interface{}{row})...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// Flushes the buffered rows
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(o.BuildMergeStaging()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// bulkWriter gathers documents per collection into chunks loaded through loader
+func (z *FullSyncer) bulkWriter(loader BulkLoader, tables *cmap.ConcurrentMap) {
+	ticker := time.NewTicker(bulkCopyFlushFrequency)
+	defer ticker.Stop()
+	chunks := make(map[string][]DBResult)
+	flushAll := func() {
+		for key, chunk := range chunks {
+			z.bulkLoad(loader, chunk, tables)
+			delete(chunks, key)
+		}
+	}
+ForStatement:
+	for {
+		select {
+		case e, more := <-z.C:
+			if !more {
+				break ForStatement
+			}
+			key := createFanKey(e.MongoDB, e.Collection)
+			if !z.tableExists(key, tables) {
+				e.markWritten()
+				continue
+			}
+			chunks[key] = append(chunks[key], e)
+			if len(chunks[key]) >= bulkCopyChunkSize {
+				z.bulkLoad(loader, chunks[key], tables)
+				delete(chunks, key)
+			}
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+	flushAll()
+	wg.Done()
+}
+
+func (z *FullSyncer) bulkLoad(loader BulkLoader, chunk []DBResult, tables *cmap.ConcurrentMap) {
+	first := chunk[0]
+	o, coll := z.statementFromDbCollection(first.MongoDB, first.Collection)
+	var rows []map[string]interface{}
+	var batch Batch
+	for _, e := range chunk {
+		op := BuildOpFromMgo(o.mongoFields(), e, coll)
+		rows = append(rows, op.Data)
+		if len(coll.Children) > 0 {
+			source := &gtm.Op{Id: op.Id, Operation: op.Operation, Data: e.Data}
+			batch.Ops = append(batch.Ops, SinkOp{Collection: coll, Data: op.Data, Children: SanitizeChildren(coll, source)})
+		}
+	}
+	load := func() error { return loader.BulkLoad(coll, rows) }
+	if len(coll.Children) > 0 {
+		// Child rows are replaced alongside their parents rather than copied
+		load = func() error { return z.Output.Write(batch) }
+	}
+	err := z.backoff.Retry(load)
+	if err == nil {
+		log.WithFields(log.Fields{
+			"collection": first.Collection,
+			"rows":       len(rows),
+		}).Info("Bulk loaded records")
+		z.insertCounter.Incr(int64(len(rows)))
+		key := createFanKey(first.MongoDB, first.Collection)
+		for _, e := range chunk {
+			metrics.Op(key, "insert")
+			e.markWritten()
+		}
+		return
+	}
+	// Fall back to individual writes so that a single bad record
+	// does not prevent the rest of the chunk loading
+	log.Warnf("Bulk load of %s failed, writing rows individually: %s", first.Collection, err.Error())
+	for _, e := range chunk {
+		z.writeResult(e, tables)
+	}
+}
@@ -0,0 +1,222 @@
+package moresql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rwynn/gtm"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sourceOplog tails local.oplog.rs through gtm
+const sourceOplog = "oplog"
+
+// sourceChangeStream consumes a cluster wide $changeStream
+const sourceChangeStream = "changestream"
+
+// changeStreamAwait is how long the server waits for novelty
+// before answering a getMore with an empty batch
+const changeStreamAwait = time.Duration(1) * time.Second
+
+type changeStreamNamespace struct {
+	DB   string `bson:"db"`
+	Coll string `bson:"coll"`
+}
+
+// ChangeEvent is the subset of a $changeStream event used by moresql
+type ChangeEvent struct {
+	ResumeToken   bson.Raw               `bson:"_id"`
+	OperationType string                 `bson:"operationType"`
+	ClusterTime   bson.MongoTimestamp    `bson:"clusterTime"`
+	Ns            changeStreamNamespace  `bson:"ns"`
+	DocumentKey   map[string]interface{} `bson:"documentKey"`
+	FullDocument  map[string]interface{} `bson:"fullDocument"`
+}
+
+type changeStreamCursor struct {
+	Id         int64      `bson:"id"`
+	NS         string     `bson:"ns"`
+	FirstBatch []bson.Raw `bson:"firstBatch"`
+	NextBatch  []bson.Raw `bson:"nextBatch"`
+}
+
+type changeStreamResult struct {
+	Cursor changeStreamCursor `bson:"cursor"`
+}
+
+// ChangeEventToOp converts a change event into the gtm.Op consumed
+// by the fan. Returns false for events that have no SQL equivalent.
+func ChangeEventToOp(e ChangeEvent) (*gtm.Op, bool) {
+	op := &gtm.Op{
+		Namespace: createFanKey(e.Ns.DB, e.Ns.Coll),
+		Timestamp: e.ClusterTime,
+		Data:      e.FullDocument,
+	}
+	if e.DocumentKey != nil {
+		op.Id = e.DocumentKey["_id"]
+	}
+	switch e.OperationType {
+	case "insert":
+		op.Operation = "i"
+	case "update", "replace":
+		// fullDocument is missing when the document was deleted
+		// before the update lookup, a delete event will follow
+		if e.FullDocument == nil {
+			return nil, false
+		}
+		op.Operation = "u"
+	case "delete":
+		op.Operation = "d"
+	default:
+		return nil, false
+	}
+	return op, true
+}
+
+// EncodeResumeToken converts the opaque resume token into
+// a string suitable for the moresql_metadata table
+func EncodeResumeToken(token bson.Raw) string {
+	if len(token.Data) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(token.Data)
+}
+
+// DecodeResumeToken reverses EncodeResumeToken
+func DecodeResumeToken(s string) (bson.Raw, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return bson.Raw{}, fmt.Errorf("Unable to decode resume token %s: %s", s, err)
+	}
+	return bson.Raw{Kind: 0x03, Data: b}, nil
+}
+
+// changeStreamOptions builds the $changeStream stage, preferring
+// the resume token over a starting timestamp
+func changeStreamOptions(token string, after bson.MongoTimestamp) (bson.D, error) {
+	opts := bson.D{
+		{Name: "allChangesForCluster", Value: true},
+		{Name: "fullDocument", Value: "updateLookup"},
+	}
+	if token != "" {
+		raw, err := DecodeResumeToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return append(opts, bson.DocElem{Name: "resumeAfter", Value: raw}), nil
+	}
+	if after != bson.MongoTimestamp(0) {
+		opts = append(opts, bson.DocElem{Name: "startAtOperationTime", Value: after})
+	}
+	return opts, nil
+}
+
+// changeStreamTail follows every collection in the cluster using $changeStream
+// and emits the results through the same channel types as gtm.Tail.
+// Requires MongoDB 4.0+.
+func changeStreamTail(session *mgo.Session, token string, after bson.MongoTimestamp, tokens *resumeTokens) (gtm.OpChan, chan error) {
+	ops := make(gtm.OpChan, 500)
+	errs := make(chan error, 1)
+	go func() {
+		s := session.Copy()
+		defer s.Close()
+		opts, err := changeStreamOptions(token, after)
+		if err != nil {
+			errs <- err
+			return
+		}
+		cmd := bson.D{
+			{Name: "aggregate", Value: 1},
+			{Name: "pipeline", Value: []bson.M{{"$changeStream": opts}}},
+			{Name: "cursor", Value: bson.M{}},
+		}
+		adminDB := s.DB("admin")
+		var result changeStreamResult
+		if err := adminDB.Run(cmd, &result); err != nil {
+			errs <- err
+			return
+		}
+		cursor := result.Cursor
+		batch := cursor.FirstBatch
+		// ns is reported as admin.$cmd.aggregate, getMore wants the collection part
+		collection := cursor.NS[strings.Index(cursor.NS, ".")+1:]
+		for {
+			for _, raw := range batch {
+				var e ChangeEvent
+				if err := raw.Unmarshal(&e); err != nil {
+					errs <- err
+					return
+				}
+				op, ok := ChangeEventToOp(e)
+				if !ok {
+					log.WithField("operationType", e.OperationType).Debug("Skipping change event")
+					continue
+				}
+				tokens.Set(op, EncodeResumeToken(e.ResumeToken))
+				ops <- op
+			}
+			if cursor.Id == 0 {
+				errs <- fmt.Errorf("Change stream cursor closed by server")
+				return
+			}
+			getMore := bson.D{
+				{Name: "getMore", Value: cursor.Id},
+				{Name: "collection", Value: collection},
+				{Name: "maxTimeMS", Value: int64(changeStreamAwait / time.Millisecond)},
+			}
+			result = changeStreamResult{}
+			if err := adminDB.Run(getMore, &result); err != nil {
+				errs <- err
+				return
+			}
+			cursor.Id = result.Cursor.Id
+			batch = result.Cursor.NextBatch
+		}
+	}()
+	return ops, errs
+}
+
+// resumeTokens associates each in flight op with the change stream
+// resume token it was read at, so the consumer applying the op can
+// record the token in its checkpoint
+type resumeTokens struct {
+	sync.Mutex
+	tokens map[*gtm.Op]string
+}
+
+func newResumeTokens() *resumeTokens {
+	return &resumeTokens{tokens: make(map[*gtm.Op]string)}
+}
+
+func (r *resumeTokens) Set(op *gtm.Op, token string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.tokens[op] = token
+}
+
+func (r *resumeTokens) Get(op *gtm.Op) string {
+	if r == nil {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.tokens[op]
+}
+
+// Release forgets op once it has been applied or skipped
+func (r *resumeTokens) Release(op *gtm.Op) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.tokens, op)
+}
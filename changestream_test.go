@@ -0,0 +1,57 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *MySuite) TestChangeEventToOp(c *C) {
+	id := bson.ObjectIdHex("58a4f1e4b4c4bd6fd5d4a5b1")
+	doc := map[string]interface{}{"_id": id, "name": "Alice"}
+	key := map[string]interface{}{"_id": id}
+	ts := bson.MongoTimestamp(6378646619247607809)
+	var table = []struct {
+		opType    string
+		full      map[string]interface{}
+		ok        bool
+		operation string
+	}{
+		{"insert", doc, true, "i"},
+		{"update", doc, true, "u"},
+		{"replace", doc, true, "u"},
+		{"update", nil, false, ""},
+		{"delete", nil, true, "d"},
+		{"drop", nil, false, ""},
+		{"invalidate", nil, false, ""},
+	}
+	for _, t := range table {
+		e := m.ChangeEvent{OperationType: t.opType, ClusterTime: ts, DocumentKey: key, FullDocument: t.full}
+		e.Ns.DB = "company"
+		e.Ns.Coll = "users"
+		op, ok := m.ChangeEventToOp(e)
+		c.Check(ok, Equals, t.ok)
+		if !t.ok {
+			continue
+		}
+		c.Check(op.Operation, Equals, t.operation)
+		c.Check(op.Id, Equals, id)
+		c.Check(op.Timestamp, Equals, ts)
+		c.Check(op.GetDatabase(), Equals, "company")
+		c.Check(op.GetCollection(), Equals, "users")
+	}
+}
+
+func (s *MySuite) TestResumeTokenRoundTrip(c *C) {
+	b, err := bson.Marshal(bson.M{"_data": "825C9F3E2E000000012B022C0100296E5A1004"})
+	c.Assert(err, Equals, nil)
+	token := bson.Raw{Kind: 0x03, Data: b}
+	encoded := m.EncodeResumeToken(token)
+	decoded, err := m.DecodeResumeToken(encoded)
+	c.Check(err, Equals, nil)
+	c.Check(decoded, DeepEquals, token)
+
+	c.Check(m.EncodeResumeToken(bson.Raw{}), Equals, "")
+	_, err = m.DecodeResumeToken("not hex")
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,77 @@
+package moresql
+
+import (
+	"github.com/rwynn/gtm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// childElementPath reads a scalar array element within Child.Fields,
+// ie tags: ["a", "b"]
+const childElementPath = "$"
+
+const (
+	defaultParentKey = "parent_id"
+	defaultIndexKey  = "array_index"
+)
+
+// table describes the child's Postgres table. ParentKey takes the type of
+// parent's _id and IndexKey is an integer.
+func (c Child) table(parent Collection) Collection {
+	fields := Fields{}
+	for k, v := range c.Fields {
+		fields[k] = v
+	}
+	idType := parent.Fields["_id"].Postgres.Type
+	if idType == "" {
+		idType = "text"
+	}
+	fields[c.ParentKey] = Field{Mongo{c.ParentKey, ""}, Postgres{c.ParentKey, idType}}
+	fields[c.IndexKey] = Field{Mongo{c.IndexKey, "int"}, Postgres{c.IndexKey, "integer"}}
+	return Collection{Name: parent.Name + "." + c.Path, PgTable: c.PgTable, PgSchema: c.PgSchema, Fields: fields}
+}
+
+// parentColumn is the column of the child's table holding the parent's _id
+func (c Child) parentColumn() Postgres {
+	return Postgres{Name: c.ParentKey}
+}
+
+// SanitizeChildren builds the rows of each of c.Children from op, in the
+// same order as c.Children. Deletes have no rows as their children are only
+// removed, as do documents where the path is missing or not an array.
+func SanitizeChildren(c Collection, op *gtm.Op) [][]map[string]interface{} {
+	if len(c.Children) == 0 || !IsInsertUpdateDelete(op) {
+		return nil
+	}
+	children := make([][]map[string]interface{}, len(c.Children))
+	if op.IsDelete() {
+		return children
+	}
+	parent := NormalizeBSON(op.Id)
+	for i, child := range c.Children {
+		// Elements are normalized as their fields are extracted
+		value, _ := extractRaw(op.Data, child.Path)
+		elements, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		for n, e := range elements {
+			if !isDocument(e) {
+				e = map[string]interface{}{childElementPath: e}
+			}
+			row := sanitizeDocument(child.Fields, e)
+			row[child.ParentKey] = parent
+			row[child.IndexKey] = n
+			children[i] = append(children[i], row)
+		}
+	}
+	return children
+}
+
+// isDocument is true for the forms objects take when decoded from BSON
+func isDocument(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, bson.M, bson.D:
+		return true
+	}
+	return false
+}
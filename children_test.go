@@ -0,0 +1,125 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const childrenConfig = `{
+  "library": {
+    "pg_schema": "books",
+    "collections": {
+      "authors": {
+        "name": "authors",
+        "pg_table": "authors",
+        "fields": {"_id": "id", "name": "text"},
+        "children": {
+          "tags": {
+            "pg_table": "author_tags",
+            "fields": {"$": {"mongo": {"name": "$", "type": "text"}, "postgres": {"name": "tag", "type": "text"}}}
+          },
+          "books": {
+            "pg_table": "author_books",
+            "pg_schema": "catalog",
+            "parent_key": "author_id",
+            "index_key": "position",
+            "fields": {"product_id": "integer", "title": "text", "meta.isbn": "text"}
+          }
+        }
+      }
+    }
+  }
+}`
+
+func (s *MySuite) TestLoadConfigChildren(c *C) {
+	config, err := m.LoadConfigString(childrenConfig)
+	c.Assert(err, IsNil)
+	children := config["library"].Collections["authors"].Children
+	c.Assert(children, HasLen, 2)
+
+	books := children[0]
+	c.Check(books.Path, Equals, "books")
+	c.Check(books.PgTable, Equals, "author_books")
+	c.Check(books.PgSchema, Equals, "catalog")
+	c.Check(books.ParentKey, Equals, "author_id")
+	c.Check(books.IndexKey, Equals, "position")
+	c.Check(books.Fields["meta.isbn"].Postgres.Name, Equals, "meta_isbn")
+
+	tags := children[1]
+	c.Check(tags.Path, Equals, "tags")
+	c.Check(tags.PgSchema, Equals, "books")
+	c.Check(tags.ParentKey, Equals, "parent_id")
+	c.Check(tags.IndexKey, Equals, "array_index")
+}
+
+func (s *MySuite) TestLoadConfigChildrenErrors(c *C) {
+	cases := map[string]string{
+		"missing pg_table": `{"fields": {"title": "text"}}`,
+		"missing fields":   `{"pg_table": "author_books"}`,
+		"same keys":        `{"pg_table": "author_books", "parent_key": "id", "index_key": "id", "fields": {"title": "text"}}`,
+		"reserved column":  `{"pg_table": "author_books", "fields": {"parent_id": "text"}}`,
+	}
+	for name, child := range cases {
+		config := `{"library": {"collections": {"authors": {"name": "authors", "pg_table": "authors",
+  "fields": {"_id": "id"}, "children": {"books": ` + child + `}}}}}`
+		_, err := m.LoadConfigString(config)
+		c.Check(err, NotNil, Commentf(name))
+	}
+}
+
+func (s *MySuite) TestSanitizeChildren(c *C) {
+	config, err := m.LoadConfigString(childrenConfig)
+	c.Assert(err, IsNil)
+	coll := config["library"].Collections["authors"]
+	id := bson.NewObjectId()
+	op := &gtm.Op{Id: id, Operation: "i", Data: map[string]interface{}{
+		"_id":  id,
+		"name": "Ursula",
+		"books": []interface{}{
+			map[string]interface{}{"product_id": 1, "title": "Earthsea", "meta": map[string]interface{}{"isbn": "123"}},
+			map[string]interface{}{"product_id": 2},
+		},
+		"tags": []interface{}{"fantasy", "science fiction"},
+	}}
+	children := m.SanitizeChildren(coll, op)
+	c.Assert(children, HasLen, 2)
+	c.Check(children[0], DeepEquals, []map[string]interface{}{
+		{"product_id": 1, "title": "Earthsea", "meta_isbn": "123", "author_id": id.Hex(), "position": 0},
+		{"product_id": 2, "title": nil, "meta_isbn": nil, "author_id": id.Hex(), "position": 1},
+	})
+	c.Check(children[1], DeepEquals, []map[string]interface{}{
+		{"tag": "fantasy", "parent_id": id.Hex(), "array_index": 0},
+		{"tag": "science fiction", "parent_id": id.Hex(), "array_index": 1},
+	})
+}
+
+func (s *MySuite) TestSanitizeChildrenWithoutArrays(c *C) {
+	config, err := m.LoadConfigString(childrenConfig)
+	c.Assert(err, IsNil)
+	coll := config["library"].Collections["authors"]
+	op := &gtm.Op{Id: "a", Operation: "u", Data: map[string]interface{}{"_id": "a", "books": "none"}}
+	// Existing child rows are still replaced, with nothing
+	c.Check(m.SanitizeChildren(coll, op), DeepEquals, [][]map[string]interface{}{nil, nil})
+
+	op = &gtm.Op{Id: "a", Operation: "d"}
+	c.Check(m.SanitizeChildren(coll, op), DeepEquals, [][]map[string]interface{}{nil, nil})
+
+	coll.Children = nil
+	c.Check(m.SanitizeChildren(coll, op), IsNil)
+}
+
+func (s *MySuite) TestNewSinkOpIncludesChildren(c *C) {
+	config, err := m.LoadConfigString(childrenConfig)
+	c.Assert(err, IsNil)
+	coll := config["library"].Collections["authors"]
+	op := &gtm.Op{Id: "a", Operation: "i", Data: map[string]interface{}{"_id": "a", "tags": []interface{}{"poetry"}}}
+	sinkOp := m.NewSinkOp(coll, op)
+	c.Check(sinkOp.Delete, Equals, false)
+	c.Check(sinkOp.Data["_id"], Equals, "a")
+	c.Check(sinkOp.Children[1], DeepEquals, []map[string]interface{}{{"tag": "poetry", "parent_id": "a", "array_index": 0}})
+
+	sinkOp = m.NewSinkOp(coll, &gtm.Op{Id: "a", Operation: "d"})
+	c.Check(sinkOp.Delete, Equals, true)
+}
@@ -0,0 +1,210 @@
+package moresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/ast"
+	"github.com/antonmedv/expr/parser"
+	"github.com/antonmedv/expr/vm"
+	"github.com/orcaman/concurrent-map"
+)
+
+// mongoTypeExpr marks a computed field, its Mongo.Name holds the expression
+const mongoTypeExpr = "expr"
+
+// isComputed is true for fields evaluating an expression
+func (f Field) isComputed() bool {
+	return strings.ToLower(f.Mongo.Type) == mongoTypeExpr
+}
+
+// UnmarshalJSON accepts computed fields written as
+// {"expr": "lower(email)", "postgres": {"name": "email", "type": "text"}}
+func (f *Field) UnmarshalJSON(b []byte) error {
+	type field Field
+	var v struct {
+		field
+		Expr string `json:"expr"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = Field(v.field)
+	if v.Expr != "" {
+		f.Mongo = Mongo{v.Expr, mongoTypeExpr}
+	}
+	return nil
+}
+
+// exprDocument is the variable holding the whole document in expressions,
+// its top level keys are also variables of their own
+const exprDocument = "doc"
+
+// programs caches compiled expressions by their source
+var programs = cmap.New()
+
+// exprFunctions are available to every expression. They return nil
+// for nil arguments so that missing keys do not fail the op.
+var exprFunctions = map[string]interface{}{
+	"lower":    func(v interface{}) interface{} { return mapString(v, strings.ToLower) },
+	"upper":    func(v interface{}) interface{} { return mapString(v, strings.ToUpper) },
+	"trim":     func(v interface{}) interface{} { return mapString(v, strings.TrimSpace) },
+	"string":   func(v interface{}) interface{} { return mapString(v, func(s string) string { return s }) },
+	"concat":   concat,
+	"coalesce": coalesce,
+}
+
+func mapString(v interface{}, fn func(string) string) interface{} {
+	if v == nil {
+		return nil
+	}
+	if s, ok := v.(string); ok {
+		return fn(s)
+	}
+	return fn(fmt.Sprint(v))
+}
+
+// concat joins its arguments as strings, skipping nils
+func concat(values ...interface{}) string {
+	var b strings.Builder
+	for _, v := range values {
+		if v != nil {
+			b.WriteString(fmt.Sprint(v))
+		}
+	}
+	return b.String()
+}
+
+// coalesce returns its first argument which is not nil
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// CompileExpression compiles the expr of a computed field, caching the result
+func CompileExpression(source string) (*vm.Program, error) {
+	if p, ok := programs.Get(source); ok {
+		return p.(*vm.Program), nil
+	}
+	tree, err := parser.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	// Undefined variables are allowed, so an unknown function would
+	// only fail once evaluated
+	calls := &functionCalls{}
+	ast.Walk(&tree.Node, calls)
+	if len(calls.unknown) > 0 {
+		return nil, fmt.Errorf("unknown function %s", strings.Join(calls.unknown, ", "))
+	}
+	p, err := expr.Compile(source, expr.Env(exprEnv(map[string]interface{}{})), expr.AllowUndefinedVariables())
+	if err != nil {
+		return nil, err
+	}
+	programs.Set(source, p)
+	return p, nil
+}
+
+// functionCalls collects the functions called by an expression which are
+// neither in exprFunctions nor builtin, builtins are parsed as BuiltinNode
+type functionCalls struct {
+	unknown []string
+}
+
+func (f *functionCalls) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	var name string
+	switch callee := call.Callee.(type) {
+	case *ast.IdentifierNode:
+		if _, ok := exprFunctions[callee.Value]; ok {
+			return
+		}
+		name = callee.Value
+	case *ast.MemberNode:
+		// Documents have no methods
+		name = "method"
+		if property, ok := callee.Property.(*ast.StringNode); ok {
+			name = property.Value
+		}
+	default:
+		name = "call"
+	}
+	loc := call.Location()
+	f.unknown = append(f.unknown, fmt.Sprintf("%s (%d:%d)", name, loc.Line, loc.Column+1))
+}
+
+// CompileExpressions compiles every computed field of config, including
+// those of children, returning an error describing each that fails
+func CompileExpressions(config Config) error {
+	var failures []string
+	check := func(name string, fields Fields) {
+		for _, k := range sortedFieldKeys(fields) {
+			f := fields[k]
+			if !f.isComputed() {
+				continue
+			}
+			if _, err := CompileExpression(f.Mongo.Name); err != nil {
+				failures = append(failures, fmt.Sprintf("%s field %s: %s", name, k, err))
+			}
+		}
+	}
+	for _, dbName := range sortedDBNames(config) {
+		db := config[dbName]
+		for _, collName := range sortedCollectionNames(db) {
+			coll := db.Collections[collName]
+			check(createFanKey(dbName, collName), coll.Fields)
+			for _, child := range coll.Children {
+				check(createFanKey(dbName, collName)+" child "+child.Path, child.Fields)
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Invalid expressions:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func sortedFieldKeys(fields Fields) []string {
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exprEnv exposes doc, normalized by NormalizeBSON, to expressions. It is
+// only built for documents with computed fields.
+func exprEnv(doc interface{}) map[string]interface{} {
+	doc = NormalizeBSON(doc)
+	env := make(map[string]interface{})
+	if m, ok := doc.(map[string]interface{}); ok {
+		for k, v := range m {
+			env[k] = v
+		}
+	}
+	env[exprDocument] = doc
+	for k, fn := range exprFunctions {
+		env[k] = fn
+	}
+	return env
+}
+
+// evaluate runs the expr of a computed field against env
+func evaluate(source string, env map[string]interface{}) (interface{}, error) {
+	p, err := CompileExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Run(p, env)
+}
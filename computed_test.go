@@ -0,0 +1,86 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func computed(expr string, pgType string) m.Field {
+	return m.Field{m.Mongo{expr, "expr"}, m.Postgres{"value", pgType}}
+}
+
+func (s *MySuite) TestComputedFieldsFromConfig(c *C) {
+	fields, err := m.JsonToFields(`{"email_lower": {"expr": "lower(email)", "postgres": {"name": "email_lower", "type": "text"}}}`)
+	c.Assert(err, IsNil)
+	c.Check(fields["email_lower"], Equals, m.Field{m.Mongo{"lower(email)", "expr"}, m.Postgres{"email_lower", "text"}})
+
+	// Longhand fields without an expr are unchanged
+	fields, err = m.JsonToFields(`{"name": {"mongo": {"name": "name", "type": "text"}, "postgres": {"name": "name", "type": "text"}}}`)
+	c.Assert(err, IsNil)
+	c.Check(fields["name"], Equals, BuildTextField("name"))
+}
+
+func (s *MySuite) TestSanitizeDataComputedFields(c *C) {
+	op := &gtm.Op{Id: "a", Operation: "i", Data: map[string]interface{}{
+		"email":       "Ada@Example.COM",
+		"name":        map[string]interface{}{"first": "Ada", "last": "Lovelace"},
+		"books":       []interface{}{"Notes", "Sketch"},
+		"price_cents": 1999,
+	}}
+	cases := []struct {
+		expr     string
+		pgType   string
+		expected interface{}
+	}{
+		{`lower(email)`, "text", "ada@example.com"},
+		{`concat(name.first, " ", name.last)`, "text", "Ada Lovelace"},
+		{`len(books)`, "integer", 2},
+		{`coalesce(nickname, name.first)`, "text", "Ada"},
+		{`price_cents / 100`, "numeric", 19.99},
+		{`doc["email"] contains "@"`, "boolean", true},
+		{`filter(books, {# startsWith "S"})`, "jsonb", `["Sketch"]`},
+		{`upper(nickname)`, "text", nil},
+		// Reading through a missing object fails, leaving the column null
+		{`missing.key`, "text", nil},
+	}
+	for _, t := range cases {
+		fields := m.Fields{"value": computed(t.expr, t.pgType)}
+		output := m.SanitizeData(fields, op)
+		c.Check(output["value"], Equals, t.expected, Commentf("expr %s", t.expr))
+	}
+}
+
+func (s *MySuite) TestCompileExpressions(c *C) {
+	config, err := m.LoadConfigString(`{
+  "app": {
+    "collections": {
+      "users": {
+        "name": "users",
+        "pg_table": "users",
+        "fields": {
+          "_id": "id",
+          "email": {"expr": "lower(email)", "postgres": {"name": "email", "type": "text"}},
+          "email_lower": {"expr": "lowr(email)", "postgres": {"name": "email_lower", "type": "text"}},
+          "full_name": {"expr": "concat(first, ", "postgres": {"name": "full_name", "type": "text"}}
+        },
+        "children": {
+          "books": {"pg_table": "user_books", "fields": {"title": {"expr": "upper(title", "postgres": {"name": "title", "type": "text"}}}}
+        }
+      }
+    }
+  }
+}`)
+	c.Assert(err, IsNil)
+	err = m.CompileExpressions(config)
+	c.Assert(err, NotNil)
+	c.Check(err.Error(), Matches, "(?s)Invalid expressions:\napp.users field email_lower: unknown function lowr \\(1:1\\)\napp.users field full_name: .*\napp.users child books field title: .*")
+	c.Check(err.Error(), Not(Matches), "(?s).*field email:.*")
+
+	users := config["app"].Collections["users"]
+	delete(users.Fields, "email_lower")
+	delete(users.Fields, "full_name")
+	users.Children = nil
+	config["app"].Collections["users"] = users
+	c.Check(m.CompileExpressions(config), IsNil)
+}
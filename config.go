@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
-
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -20,18 +20,40 @@ func LoadConfigString(s string) (Config, error) {
 		log.Fatalln(err)
 	}
 	for k, v := range configDelayed {
-		db := DB{}
+		db := DB{PgSchema: v.PgSchema}
 		collections := Collections{}
 		db.Collections = collections
 		for k, v := range v.Collections {
-			coll := Collection{Name: v.Name, PgTable: v.PgTable}
+			coll := Collection{Name: v.Name, PgTable: v.PgTable, PgSchema: v.PgSchema, Reconcile: v.Reconcile}
+			switch coll.Reconcile {
+			case "", reconcileDelete, reconcileReport:
+			default:
+				return nil, fmt.Errorf("Invalid reconcile %s for %s, choose from %s or %s", coll.Reconcile, k, reconcileDelete, reconcileReport)
+			}
+			// Collections inherit the database's pg_schema unless they set their own
+			if coll.PgSchema == "" {
+				coll.PgSchema = db.PgSchema
+			}
 			var fields Fields
 			fields, err = JsonToFields(string(v.Fields))
 			if err != nil {
-				log.Warnf("JSON Config decoding error: ", err)
+				log.Warnf("JSON Config decoding error: %s", err)
 				return nil, fmt.Errorf("Unable to decode %s", err)
 			}
 			coll.Fields = fields
+			if v.ExtraProps != "" {
+				for _, f := range fields {
+					if f.Postgres.Name == v.ExtraProps {
+						return nil, fmt.Errorf("extra_props %s of %s is already a field", v.ExtraProps, k)
+					}
+				}
+				coll.ExtraProps = v.ExtraProps
+				coll.Fields[extraPropsKey] = extraPropsField(v.ExtraProps)
+			}
+			coll.Children, err = loadChildren(k, coll, v.Children)
+			if err != nil {
+				return nil, err
+			}
 			db.Collections[k] = coll
 		}
 		config[k] = db
@@ -39,6 +61,43 @@ func LoadConfigString(s string) (Config, error) {
 	return config, nil
 }
 
+// loadChildren expands the children of collection name, sorted by path.
+// Children inherit the collection's pg_schema unless they set their own.
+func loadChildren(name string, coll Collection, delayed ChildrenDelayed) ([]Child, error) {
+	var children []Child
+	for path, v := range delayed {
+		child := Child{Path: path, PgTable: v.PgTable, PgSchema: v.PgSchema, ParentKey: v.ParentKey, IndexKey: v.IndexKey}
+		if child.PgTable == "" {
+			return nil, fmt.Errorf("Child %s of %s requires a pg_table", path, name)
+		}
+		if child.PgSchema == "" {
+			child.PgSchema = coll.PgSchema
+		}
+		if child.ParentKey == "" {
+			child.ParentKey = defaultParentKey
+		}
+		if child.IndexKey == "" {
+			child.IndexKey = defaultIndexKey
+		}
+		if child.ParentKey == child.IndexKey {
+			return nil, fmt.Errorf("Child %s of %s uses %s for both parent_key and index_key", path, name, child.ParentKey)
+		}
+		fields, err := JsonToFields(string(v.Fields))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode fields of child %s of %s: %s", path, name, err)
+		}
+		for _, f := range fields {
+			if f.Postgres.Name == child.ParentKey || f.Postgres.Name == child.IndexKey {
+				return nil, fmt.Errorf("Child %s of %s maps a field to %s, which holds its parent_key or index_key", path, name, f.Postgres.Name)
+			}
+		}
+		child.Fields = fields
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Path < children[j].Path })
+	return children, nil
+}
+
 func LoadConfig(path string) Config {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -54,8 +113,12 @@ func LoadConfig(path string) Config {
 func mongoToPostgresTypeConversion(mongoType string) string {
 	// Coerce "id" bsonId types into text since Postgres doesn't have type for BSONID
 	switch strings.ToLower(mongoType) {
-	case "id":
+	case mongoTypeId, mongoTypeObjectId, mongoTypeRegex:
 		return "text"
+	case mongoTypeDecimal:
+		return "numeric"
+	case mongoTypeBinary:
+		return "bytea"
 	}
 	return mongoType
 }
@@ -79,6 +79,16 @@ func (s *MySuite) TestConfigParsingForFields(c *C) {
 	}
 }
 
+func (s *MySuite) TestJsonToFieldsShorthandBSONTypes(c *C) {
+	f, err := m.JsonToFields(`{"owner_id": "objectid", "price": "decimal", "avatar": "binary", "pattern": "regex", "token": "uuid"}`)
+	c.Assert(err, IsNil)
+	c.Check(f["owner_id"].Postgres.Type, Equals, "text")
+	c.Check(f["price"].Postgres.Type, Equals, "numeric")
+	c.Check(f["avatar"].Postgres.Type, Equals, "bytea")
+	c.Check(f["pattern"].Postgres.Type, Equals, "text")
+	c.Check(f["token"].Postgres.Type, Equals, "uuid")
+}
+
 func (s *MySuite) TestConfigParsingFull(c *C) {
 	// Fields struct
 	ex1 := `
@@ -163,3 +173,51 @@ func (s *MySuite) TestConfigParsingFull(c *C) {
 		c.Check(err, Equals, nil)
 	}
 }
+
+func (s *MySuite) TestConfigParsingPgSchema(c *C) {
+	ex := `
+{
+  "company-production": {
+    "pg_schema": "production",
+    "collections": {
+      "accounts": {
+        "name": "users",
+        "pg_table": "users",
+        "fields": {"_id": "id"}
+      },
+      "campaigns": {
+        "name": "campaigns",
+        "pg_table": "campaigns",
+        "pg_schema": "marketing",
+        "fields": {"_id": "id"}
+      }
+    }
+  },
+  "company-staging": {
+    "collections": {
+      "accounts": {
+        "name": "users",
+        "pg_table": "users",
+        "fields": {"_id": "id"}
+      }
+    }
+  }
+}`
+	config, err := m.LoadConfigString(ex)
+	c.Assert(err, IsNil)
+	c.Check(config["company-production"].PgSchema, Equals, "production")
+	c.Check(config["company-production"].Collections["accounts"].PgSchema, Equals, "production")
+	c.Check(config["company-production"].Collections["campaigns"].PgSchema, Equals, "marketing")
+	c.Check(config["company-staging"].Collections["accounts"].PgSchema, Equals, "")
+}
+
+func (s *MySuite) TestConfigParsingReconcile(c *C) {
+	valid := `{"db": {"collections": {"users": {"name": "users", "pg_table": "users", "reconcile": "delete", "fields": {"_id": "id"}}}}}`
+	config, err := m.LoadConfigString(valid)
+	c.Assert(err, IsNil)
+	c.Check(config["db"].Collections["users"].Reconcile, Equals, "delete")
+
+	invalid := `{"db": {"collections": {"users": {"name": "users", "pg_table": "users", "reconcile": "purge", "fields": {"_id": "id"}}}}}`
+	_, err = m.LoadConfigString(invalid)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,199 @@
+package moresql
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// deadLetterPageSize is the number of rows fetched at a time by -replay-dead-letters
+const deadLetterPageSize = 500
+
+// DeadLetter is an op which could not be applied to the sink
+// along with the error that prevented it
+type DeadLetter struct {
+	Id          int64     `db:"id"`
+	AppName     string    `db:"app_name"`
+	Namespace   string    `db:"namespace"`
+	Operation   string    `db:"operation"`
+	OpId        string    `db:"op_id"`
+	Document    string    `db:"document"`
+	OpTimestamp int64     `db:"op_timestamp"`
+	Error       string    `db:"error"`
+	Attempts    int       `db:"attempts"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type deadLetterDocument struct {
+	Id   interface{}            `json:"_id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// NewDeadLetter captures op and the error it failed with. The unsanitized
+// op is stored as extended JSON so that it can be replayed through the
+// field mapping in effect at replay time.
+func NewDeadLetter(appName string, op *gtm.Op, err error) DeadLetter {
+	b, jsonErr := bson.MarshalJSON(deadLetterDocument{op.Id, op.Data})
+	if jsonErr != nil {
+		log.Errorf("Unable to encode dead letter document %s", jsonErr.Error())
+		b = []byte("{}")
+	}
+	return DeadLetter{
+		AppName:     appName,
+		Namespace:   op.Namespace,
+		Operation:   op.Operation,
+		OpId:        FormatMongoId(op.Id),
+		Document:    string(b),
+		OpTimestamp: int64(op.Timestamp),
+		Error:       err.Error(),
+		Attempts:    1,
+		CreatedAt:   time.Now(),
+	}
+}
+
+// Op rebuilds the op captured by NewDeadLetter
+func (d DeadLetter) Op() (*gtm.Op, error) {
+	var doc deadLetterDocument
+	if err := bson.UnmarshalJSON([]byte(d.Document), &doc); err != nil {
+		return nil, err
+	}
+	return &gtm.Op{
+		Id:        doc.Id,
+		Operation: d.Operation,
+		Namespace: d.Namespace,
+		Data:      doc.Data,
+		Timestamp: bson.MongoTimestamp(d.OpTimestamp),
+	}, nil
+}
+
+// applyToSink performs the single write described by op. Ops with child
+// rows are written as a batch so the rows are replaced atomically.
+func applyToSink(sink Sink, op SinkOp) error {
+	if len(op.Collection.Children) > 0 {
+		return sink.Write(Batch{Ops: []SinkOp{op}})
+	}
+	if op.Delete {
+		return sink.Delete(op.Collection, op.Data)
+	}
+	return sink.Upsert(op.Collection, op.Data)
+}
+
+// UnrecordedError is returned by WriteOrDeadLetter for an op which could be
+// neither applied nor recorded as a dead letter
+type UnrecordedError struct {
+	Err           error
+	DeadLetterErr error
+}
+
+func (e *UnrecordedError) Error() string {
+	return fmt.Sprintf("%s, writing dead letter failed: %s", e.Err, e.DeadLetterErr)
+}
+
+// WriteOrDeadLetter applies op to sink with retries. Failures are recorded as
+// dead letters so they are not silently lost, returning the write's error.
+// When the dead letter cannot be written either an *UnrecordedError is returned.
+func WriteOrDeadLetter(sink Sink, backoff Backoff, appName string, source *gtm.Op, op SinkOp) error {
+	err := backoff.Retry(func() error { return applyToSink(sink, op) })
+	if err == nil {
+		return nil
+	}
+	metrics.Error(source.Namespace)
+	log.WithFields(log.Fields{
+		"collection": op.Collection.Name,
+		"id":         source.Id,
+		"error":      err,
+	}).Error("Unable to apply op, writing dead letter")
+	dlErr := backoff.Retry(func() error { return sink.DeadLetter(NewDeadLetter(appName, source, err)) })
+	if dlErr != nil {
+		return &UnrecordedError{Err: err, DeadLetterErr: dlErr}
+	}
+	return err
+}
+
+// haltIfUnrecorded exits when err is an *UnrecordedError. The op is never
+// marked applied, so with -checkpoint it is replayed on the next start
+// rather than skipped.
+func haltIfUnrecorded(source *gtm.Op, err error) {
+	if _, ok := err.(*UnrecordedError); !ok {
+		return
+	}
+	log.WithFields(log.Fields{
+		"collection": source.Namespace,
+		"id":         source.Id,
+		"error":      err,
+	}).Fatal("Unable to apply op or write dead letter, exiting to resume from the last checkpoint")
+}
+
+// ReplayDeadLetters reapplies every dead letter for this app using the current
+// configuration. Rows that succeed are removed, rows that fail again have their
+// error and attempt count updated.
+func ReplayDeadLetters(config Config, pg *sqlx.DB, env Env) {
+	q := Queries{Schema: env.metadataSchema}
+	sink := NewPostgresSink(pg, env.metadataSchema)
+	backoff := NewBackoff(env.retryAttempts, env.retryMaxBackoff)
+	var replayed, failed, skipped int
+	var lastId int64
+	for {
+		var letters []DeadLetter
+		if err := pg.Select(&letters, q.GetDeadLetters(), env.appName, lastId, deadLetterPageSize); err != nil {
+			log.Fatalf("Unable to read moresql_dead_letters: %s", err.Error())
+		}
+		if len(letters) == 0 {
+			break
+		}
+		for _, d := range letters {
+			lastId = d.Id
+			op, err := d.Op()
+			if err != nil {
+				log.Errorf("Unable to decode dead letter %d: %s", d.Id, err.Error())
+				failed++
+				continue
+			}
+			db, coll := op.GetDatabase(), op.GetCollection()
+			c, ok := config[db].Collections[coll]
+			if !ok {
+				log.Warnf("Skipping dead letter %d, %s is no longer configured", d.Id, op.Namespace)
+				skipped++
+				continue
+			}
+			o := Statement{c}
+			EnsureOpHasAllFields(op, o.mongoFields())
+			s := NewSinkOp(c, op)
+			err = backoff.Retry(func() error { return applyToSink(sink, s) })
+			if err != nil {
+				failed++
+				d.Error = err.Error()
+				if _, err := pg.NamedExec(q.UpdateDeadLetter(), d); err != nil {
+					log.Errorf("Unable to update dead letter %d: %s", d.Id, err.Error())
+				}
+				continue
+			}
+			replayed++
+			if _, err := pg.Exec(q.DeleteDeadLetter(), d.Id); err != nil {
+				log.Errorf("Unable to remove replayed dead letter %d: %s", d.Id, err.Error())
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"replayed": replayed,
+		"failed":   failed,
+		"skipped":  skipped,
+	}).Info("Finished replaying dead letters")
+	if failed > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// EnsureDeadLettersTable creates moresql_dead_letters when missing
+func EnsureDeadLettersTable(pg *sqlx.DB, schema string) {
+	q := Queries{Schema: schema}
+	if _, err := pg.Exec(q.CreateDeadLettersTable()); err != nil {
+		log.Errorf("Unable to create moresql_dead_letters, failed writes will only be logged: %s", err.Error())
+	}
+}
@@ -0,0 +1,69 @@
+package moresql_test
+
+import (
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *MySuite) TestDeadLetterRoundTrip(c *C) {
+	id := bson.ObjectIdHex("58a4f1e4b4c4bd6fd5d4a5b1")
+	data := map[string]interface{}{
+		"_id":     id,
+		"name":    "Alice",
+		"address": map[string]interface{}{"home": true},
+	}
+	op := &gtm.Op{Id: id, Operation: "u", Namespace: "company.users", Data: data, Timestamp: bson.MongoTimestamp(6378646619247607809)}
+	d := m.NewDeadLetter("moresql", op, errors.New(`pq: column "name" is of type integer`))
+	c.Check(d.AppName, Equals, "moresql")
+	c.Check(d.Namespace, Equals, "company.users")
+	c.Check(d.Operation, Equals, "u")
+	c.Check(d.OpId, Equals, "58a4f1e4b4c4bd6fd5d4a5b1")
+	c.Check(d.Error, Equals, `pq: column "name" is of type integer`)
+
+	replay, err := d.Op()
+	c.Assert(err, Equals, nil)
+	c.Check(replay.Id, Equals, id)
+	c.Check(replay.Operation, Equals, "u")
+	c.Check(replay.Namespace, Equals, "company.users")
+	c.Check(replay.Timestamp, Equals, op.Timestamp)
+	c.Check(replay.Data["_id"], Equals, id)
+	c.Check(replay.Data["name"], Equals, "Alice")
+	c.Check(replay.Data["address"], DeepEquals, map[string]interface{}{"home": true})
+}
+
+func noSleepBackoff(attempts int) m.Backoff {
+	return m.Backoff{Attempts: attempts, Sleep: func(time.Duration) {}}
+}
+
+func (s *MySuite) TestWriteOrDeadLetter(c *C) {
+	op := &gtm.Op{Id: "a", Operation: "i", Namespace: "app.users", Data: map[string]interface{}{"_id": "a"}}
+	write := m.SinkOp{Collection: m.Collection{Name: "users"}, Data: map[string]interface{}{"_id": "a"}}
+
+	permanent := &pq.Error{Code: "23505"}
+	sink := &fakeSink{err: permanent}
+	err := m.WriteOrDeadLetter(sink, noSleepBackoff(3), "app", op, write)
+	c.Check(err, Equals, permanent)
+	c.Check(sink.calls, DeepEquals, []string{"upsert users", "dead letter"})
+	c.Assert(sink.deadLetters, HasLen, 1)
+	c.Check(sink.deadLetters[0].OpId, Equals, "a")
+
+	// Transient failures of the dead letter are retried too
+	sink = &fakeSink{err: driver.ErrBadConn, deadLetterErr: driver.ErrBadConn}
+	err = m.WriteOrDeadLetter(sink, noSleepBackoff(2), "app", op, write)
+	unrecorded, ok := err.(*m.UnrecordedError)
+	c.Assert(ok, Equals, true)
+	c.Check(unrecorded.Err, Equals, driver.ErrBadConn)
+	c.Check(unrecorded.DeadLetterErr, Equals, driver.ErrBadConn)
+	c.Check(sink.calls, DeepEquals, []string{"upsert users", "upsert users", "dead letter", "dead letter"})
+
+	sink = &fakeSink{}
+	c.Check(m.WriteOrDeadLetter(sink, noSleepBackoff(2), "app", op, write), IsNil)
+	c.Check(sink.calls, DeepEquals, []string{"upsert users"})
+}
@@ -0,0 +1,73 @@
+package moresql
+
+import (
+	"encoding/json"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rwynn/gtm"
+	"github.com/tidwall/match"
+)
+
+// mongoTypeExtraProps marks the field holding every top level key of the
+// document which is not otherwise mapped
+const mongoTypeExtraProps = "extra_props"
+
+// extraPropsKey is the Fields key of a collection's extra_props column.
+// It is not read as a path.
+const extraPropsKey = "$extra_props"
+
+func extraPropsField(column string) Field {
+	return Field{Mongo{"", mongoTypeExtraProps}, Postgres{column, "jsonb"}}
+}
+
+// isExtraProps is true for the field added for a collection's extra_props
+func (f Field) isExtraProps() bool {
+	return strings.ToLower(f.Mongo.Type) == mongoTypeExtraProps
+}
+
+// mapped is true when key is read by the path of one of c's fields or children.
+// Keys named by a whole path are also mapped, as EnsureOpHasAllFields
+// adds them to documents missing the path.
+func (c Collection) mapped(key string) bool {
+	paths := make([]string, 0, len(c.Fields)+len(c.Children))
+	for k, f := range c.Fields {
+		if !f.isExtraProps() && !f.isComputed() {
+			paths = append(paths, k)
+		}
+	}
+	for _, child := range c.Children {
+		paths = append(paths, child.Path)
+	}
+	for _, path := range paths {
+		if key == path {
+			return true
+		}
+		part, wild, _, _ := splitObjectPath(path)
+		if (wild && match.Match(key, part)) || key == part {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeCollection sanitizes op for c as SanitizeData does, adding the
+// unmapped keys of the document to the extra_props column as JSON
+func sanitizeCollection(c Collection, op *gtm.Op) map[string]interface{} {
+	output := SanitizeData(c.Fields, op)
+	if c.ExtraProps == "" || !IsInsertUpdateDelete(op) {
+		return output
+	}
+	extra := make(map[string]interface{})
+	for k, v := range op.Data {
+		if !c.mapped(k) {
+			extra[k] = NormalizeBSON(v)
+		}
+	}
+	b, err := json.Marshal(extra)
+	if err != nil {
+		log.Errorf("Failed to marshal extra_props of %s into json %s", c.Name, err.Error())
+	}
+	output[c.ExtraProps] = string(b)
+	return output
+}
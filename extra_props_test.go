@@ -0,0 +1,85 @@
+package moresql_test
+
+import (
+	"encoding/json"
+
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+const extraPropsConfig = `{
+  "app": {
+    "collections": {
+      "users": {
+        "name": "users",
+        "pg_table": "users",
+        "extra_props": "extra",
+        "fields": {"_id": "id", "name.first": "text", "pref*": "jsonb", "books.#.title": "jsonb"},
+        "children": {
+          "tags": {"pg_table": "user_tags", "fields": {"$": {"mongo": {"name": "$", "type": "text"}, "postgres": {"name": "tag", "type": "text"}}}}
+        }
+      }
+    }
+  }
+}`
+
+func extraProps(c *C, data map[string]interface{}) map[string]interface{} {
+	var extra map[string]interface{}
+	s, ok := data["extra"].(string)
+	c.Assert(ok, Equals, true)
+	c.Assert(json.Unmarshal([]byte(s), &extra), IsNil)
+	return extra
+}
+
+func (s *MySuite) TestLoadConfigExtraProps(c *C) {
+	config, err := m.LoadConfigString(extraPropsConfig)
+	c.Assert(err, IsNil)
+	coll := config["app"].Collections["users"]
+	c.Check(coll.ExtraProps, Equals, "extra")
+	c.Check(coll.Fields["$extra_props"].Postgres, Equals, m.Postgres{"extra", "jsonb"})
+
+	_, err = m.LoadConfigString(`{"app": {"collections": {"users": {"name": "users", "pg_table": "users",
+  "extra_props": "name", "fields": {"_id": "id", "name": "text"}}}}}`)
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestExtraPropsHoldsUnmappedKeys(c *C) {
+	config, err := m.LoadConfigString(extraPropsConfig)
+	c.Assert(err, IsNil)
+	coll := config["app"].Collections["users"]
+	op := &gtm.Op{Id: "a", Operation: "i", Data: map[string]interface{}{
+		"_id":         "a",
+		"name":        map[string]interface{}{"first": "Ada", "last": "Lovelace"},
+		"preferences": map[string]interface{}{"email": true},
+		"books":       []interface{}{map[string]interface{}{"title": "Notes"}},
+		"tags":        []interface{}{"maths"},
+		"age":         36,
+		"address":     map[string]interface{}{"city": "London"},
+	}}
+	data := m.NewSinkOp(coll, op).Data
+	c.Check(data["name_first"], Equals, "Ada")
+	c.Check(extraProps(c, data), DeepEquals, map[string]interface{}{
+		"age":     float64(36),
+		"address": map[string]interface{}{"city": "London"},
+	})
+}
+
+func (s *MySuite) TestExtraPropsFullSync(c *C) {
+	config, err := m.LoadConfigString(extraPropsConfig)
+	c.Assert(err, IsNil)
+	coll := config["app"].Collections["users"]
+	doc := map[string]interface{}{"_id": "a", "age": 36}
+	mongoFields := []string{"_id", "books.#.title", "name.first", "pref*"}
+	op := m.BuildOpFromMgo(mongoFields, m.DBResult{Data: doc}, coll)
+	// Paths missing from the document are not extra
+	c.Check(extraProps(c, op.Data), DeepEquals, map[string]interface{}{"age": float64(36)})
+}
+
+func (s *MySuite) TestExtraPropsEmpty(c *C) {
+	config, err := m.LoadConfigString(extraPropsConfig)
+	c.Assert(err, IsNil)
+	coll := config["app"].Collections["users"]
+	op := &gtm.Op{Id: "a", Operation: "u", Data: map[string]interface{}{"_id": "a"}}
+	c.Check(m.NewSinkOp(coll, op).Data["extra"], Equals, "{}")
+}
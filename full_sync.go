@@ -3,14 +3,18 @@ package moresql
 import (
 	"expvar"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/orcaman/concurrent-map"
 	"github.com/paulbellamy/ratecounter"
 	"github.com/rwynn/gtm"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type Syncer interface {
@@ -21,40 +25,220 @@ type Syncer interface {
 
 type FullSyncer struct {
 	Config Config
-	Output *sqlx.DB
+	Output Sink
 	Mongo  *mgo.Session
 	C      chan DBResult
 	done   chan bool
 
+	appName   string
+	backoff   Backoff
+	selection SyncSelection
+	progress  *syncProgressStore
+	// readers is the number of concurrent cursors, partitions
+	// the number of _id ranges each collection is split into
+	readers    int
+	partitions int
+	bulkCopy   bool
+	// restart discards the progress of the selected collections
+	// rather than resuming their full sync
+	restart bool
+
 	insertCounter *ratecounter.RateCounter
 	readCounter   *ratecounter.RateCounter
 }
 
 func (z *FullSyncer) Read() {
-	for dbName, v := range z.Config {
-		db := z.Mongo.DB(dbName)
-		for name := range v.Collections {
-			coll := db.C(name)
-			iter := coll.Find(nil).Iter()
-			var result map[string]interface{}
-			for iter.Next(&result) {
-				z.readCounter.Incr(1)
-				z.C <- DBResult{dbName, name, result}
-				// Clear out result data for next round
-				result = make(map[string]interface{})
-			}
-			if err := iter.Close(); err != nil {
-				log.Error("Unable to close iterator: %s", err)
+	targets := z.targets()
+	var namespaces []string
+	for _, t := range targets {
+		namespaces = append(namespaces, createFanKey(t.db, t.name))
+	}
+	reset := z.progress.ResetIfComplete
+	if z.restart {
+		reset = z.progress.Reset
+	}
+	if err := reset(namespaces); err != nil {
+		log.Errorf("Unable to reset full sync progress: %s", err)
+	}
+	// Ranges from every collection share the readers so that
+	// several collections are read at once
+	ranges := make(chan *syncRange)
+	var readers sync.WaitGroup
+	for i := 0; i < z.readers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for r := range ranges {
+				z.readRange(r)
 			}
+		}()
+	}
+	for _, t := range targets {
+		for _, r := range z.planRanges(t) {
+			ranges <- r
 		}
 	}
+	close(ranges)
+	readers.Wait()
 	close(z.C)
 	wg.Done()
 }
 
+type syncTarget struct {
+	db   string
+	name string
+}
+
+// targets lists the collections selected for syncing in a stable order
+func (z *FullSyncer) targets() []syncTarget {
+	var targets []syncTarget
+	for _, dbName := range sortedDBNames(z.Config) {
+		for _, name := range sortedCollectionNames(z.Config[dbName]) {
+			if _, ok := z.selection.Filter(createFanKey(dbName, name)); ok {
+				targets = append(targets, syncTarget{dbName, name})
+			}
+		}
+	}
+	return targets
+}
+
+// planRanges returns the unfinished _id ranges of a collection. Ranges are
+// recorded before reading begins so that a restart reuses the same bounds.
+func (z *FullSyncer) planRanges(t syncTarget) []*syncRange {
+	key := createFanKey(t.db, t.name)
+	filter, _ := z.selection.Filter(key)
+	rows := z.progress.Get(key)
+	if len(rows) == 0 {
+		rows = z.partition(t, filter)
+	}
+	var ranges []*syncRange
+	for _, p := range rows {
+		if p.CompletedAt.Valid {
+			continue
+		}
+		r := &syncRange{db: t.db, name: t.name, filter: filter, progress: p}
+		var err error
+		if r.min, err = decodeNullSyncId(p.RangeMin); err == nil {
+			if r.max, err = decodeNullSyncId(p.RangeMax); err == nil {
+				r.lastId, err = decodeNullSyncId(p.LastId)
+			}
+		}
+		if err != nil {
+			log.Errorf("Unable to decode full sync progress for %s range %d, skipping it: %s", key, p.RangeIndex, err)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		log.WithField("collection", key).Info("Skipping collection, already fully synced")
+	}
+	return ranges
+}
+
+func (z *FullSyncer) partition(t syncTarget, filter interface{}) []SyncProgress {
+	key := createFanKey(t.db, t.name)
+	session := z.Mongo.Copy()
+	defer session.Close()
+	coll := session.DB(t.db).C(t.name)
+	total, err := coll.Find(filter).Count()
+	if err != nil {
+		log.Warnf("Unable to count %s: %s", key, err)
+	}
+	boundaries := sampleBoundaries(coll, filter, total, z.partitions)
+	// Ranges are [nil, b0), [b0, b1) ... [bn, nil)
+	bounds := append([]interface{}{nil}, boundaries...)
+	bounds = append(bounds, nil)
+	var rows []SyncProgress
+	for i := 0; i < len(bounds)-1; i++ {
+		p := SyncProgress{AppName: z.appName, Namespace: key, RangeIndex: i, Total: int64(total)}
+		var errMin, errMax error
+		p.RangeMin, errMin = encodeNullSyncId(bounds[i])
+		p.RangeMax, errMax = encodeNullSyncId(bounds[i+1])
+		if errMin != nil || errMax != nil {
+			log.Warnf("Unable to encode _id ranges for %s, reading it with a single cursor", key)
+			rows = []SyncProgress{{AppName: z.appName, Namespace: key, Total: int64(total)}}
+			break
+		}
+		rows = append(rows, p)
+	}
+	for _, p := range rows {
+		z.progress.Save(p)
+	}
+	log.WithFields(log.Fields{
+		"collection": key,
+		"total":      total,
+		"ranges":     len(rows),
+	}).Info("Partitioned collection for full sync")
+	return rows
+}
+
+// readRange sends documents in _id order, resuming after the last _id
+// recorded. Progress is saved only once every document before it has
+// been written.
+func (z *FullSyncer) readRange(r *syncRange) {
+	key := createFanKey(r.db, r.name)
+	session := z.Mongo.Copy()
+	defer session.Close()
+	coll := session.DB(r.db).C(r.name)
+	log.WithFields(log.Fields{
+		"collection": key,
+		"range":      r.progress.RangeIndex,
+		"filter":     r.filter,
+		"after":      r.lastId,
+		"synced":     r.progress.Synced,
+	}).Info("Starting full sync of range")
+	iter := coll.Find(RangeFilter(r.filter, r.min, r.max, r.lastId)).Sort("_id").Iter()
+	var result map[string]interface{}
+	var read int
+	for iter.Next(&result) {
+		z.readCounter.Incr(1)
+		r.pending.Add(1)
+		z.C <- DBResult{MongoDB: r.db, Collection: r.name, Data: result, done: r.pending.Done}
+		r.lastId = result["_id"]
+		read++
+		if read%syncProgressInterval == 0 {
+			z.saveProgress(r, read)
+			read = 0
+		}
+		// Clear out result data for next round
+		result = make(map[string]interface{})
+	}
+	if err := iter.Close(); err != nil {
+		log.Errorf("Unable to close iterator: %s", err)
+		z.saveProgress(r, read)
+		return
+	}
+	r.progress.CompletedAt = pq.NullTime{Time: time.Now(), Valid: true}
+	z.saveProgress(r, read)
+}
+
+func (z *FullSyncer) saveProgress(r *syncRange, read int) {
+	r.pending.Wait()
+	r.progress.Synced += int64(read)
+	id, err := encodeNullSyncId(r.lastId)
+	if err != nil {
+		log.Errorf("Unable to encode full sync progress for %s: %s", r.progress.Namespace, err)
+		return
+	}
+	if id.Valid {
+		r.progress.LastId = id
+	}
+	z.progress.Save(r.progress)
+}
+
 func (z *FullSyncer) Write() {
-	var workers [workerCountOverflow]int
 	tables := z.buildTables()
+	if loader, ok := z.Output.(BulkLoader); ok && z.bulkCopy {
+		for i := 0; i < workerCount; i++ {
+			wg.Add(1)
+			go z.bulkWriter(loader, &tables)
+		}
+		wg.Done()
+		return
+	} else if z.bulkCopy {
+		log.Warn("Output does not support -bulk-copy, writing rows individually")
+	}
+	var workers [workerCountOverflow]int
 	for _ = range workers {
 		wg.Add(1)
 		go z.writer(&tables)
@@ -70,7 +254,7 @@ func BuildOpFromMgo(mongoFields []string, e DBResult, coll Collection) *gtm.Op {
 	// Set to I so we are consistent about these beings inserts
 	// This avoids our guardclause in sanitize
 	opRef.Operation = "i"
-	data := SanitizeData(coll.Fields, opRef)
+	data := sanitizeCollection(coll, opRef)
 	opRef.Data = data
 	return opRef
 }
@@ -83,37 +267,53 @@ ForStatement:
 			if !more {
 				break ForStatement
 			}
-			key := createFanKey(e.MongoDB, e.Collection)
-			v, ok := tables.Get(key)
-			if ok && !v.(bool) {
-				// Table doesn't exist, skip
-				break
-			}
-			o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
-			op := BuildOpFromMgo(o.mongoFields(), e, coll)
-			s := o.BuildUpsert()
-			log.WithFields(log.Fields{
-				"collection": e.Collection,
-				"id":         op.Id,
-			}).Info("Syncing record")
-			log.Debug("SQL Command ", s)
-			log.Debug("Data ", op.Data)
-			log.Debug("Executing statement: ", s)
-			_, err := z.Output.NamedExec(s, op.Data)
-			log.Debug("Statement executed successfully")
-			z.insertCounter.Incr(1)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"description": err,
-				}).Error("Error")
-				if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, e.Collection) {
-					tables.Set(key, false)
-				}
-			}
+			z.writeResult(e, tables)
 		}
 	}
 	wg.Done()
 }
+
+// writeResult upserts a single document, returning the error of a write
+// which was dead lettered
+func (z *FullSyncer) writeResult(e DBResult, tables *cmap.ConcurrentMap) error {
+	defer e.markWritten()
+	key := createFanKey(e.MongoDB, e.Collection)
+	if !z.tableExists(key, tables) {
+		return fmt.Errorf("table for %s is missing", key)
+	}
+	o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
+	op := BuildOpFromMgo(o.mongoFields(), e, coll)
+	log.WithFields(log.Fields{
+		"collection": e.Collection,
+		"id":         op.Id,
+	}).Info("Syncing record")
+	log.Debug("Data ", op.Data)
+	// Dead letters hold the document as read, op.Data is already sanitized
+	source := &gtm.Op{Id: op.Id, Operation: op.Operation, Namespace: key, Data: e.Data}
+	err := WriteOrDeadLetter(z.Output, z.backoff, z.appName, source, SinkOp{Collection: coll, Data: op.Data, Children: SanitizeChildren(coll, source)})
+	// Exits before the document is marked written so a resumed sync reads it again
+	haltIfUnrecorded(source, err)
+	z.insertCounter.Incr(1)
+	if err != nil {
+		z.markMissingTable(key, e.Collection, err, tables)
+	} else {
+		metrics.Op(key, "insert")
+		log.Debug("Statement executed successfully")
+	}
+	return err
+}
+
+func (z *FullSyncer) tableExists(key string, tables *cmap.ConcurrentMap) bool {
+	v, ok := tables.Get(key)
+	// Table doesn't exist, skip
+	return !(ok && !v.(bool))
+}
+
+func (z *FullSyncer) markMissingTable(key string, collection string, err error, tables *cmap.ConcurrentMap) {
+	if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, collection) {
+		tables.Set(key, false)
+	}
+}
 func (z *FullSyncer) statementFromDbCollection(db string, collectionName string) (Statement, Collection) {
 	c := z.Config[db].Collections[collectionName]
 	return Statement{c}, c
@@ -130,19 +330,103 @@ func (z *FullSyncer) buildTables() (tables cmap.ConcurrentMap) {
 	return
 }
 
-func NewSynchronizer(config Config, pg *sqlx.DB, mongo *mgo.Session) FullSyncer {
-	c := make(chan DBResult)
+func NewSynchronizer(config Config, pg *sqlx.DB, mongo *mgo.Session, env Env) FullSyncer {
+	return NewSynchronizerWithSink(config, NewPostgresSink(pg, env.metadataSchema), mongo)
+}
+
+// NewSynchronizerWithSink builds a FullSyncer which writes into sink
+// rather than the default PostgresSink
+func NewSynchronizerWithSink(config Config, sink Sink, mongo *mgo.Session) FullSyncer {
+	c := make(chan DBResult, workerCountOverflow)
 	insertCounter := ratecounter.NewRateCounter(1 * time.Second)
 	readCounter := ratecounter.NewRateCounter(1 * time.Second)
 	expvar.Publish("insert/sec", insertCounter)
 	expvar.Publish("read/sec", readCounter)
 	done := make(chan bool, 2)
-	sync := FullSyncer{config, pg, mongo, c, done, insertCounter, readCounter}
+	backoff := NewBackoff(5, time.Duration(30*time.Second))
+	sync := FullSyncer{Config: config, Output: sink, Mongo: mongo, C: c, done: done, appName: "moresql", backoff: backoff, readers: 1, partitions: 1, insertCounter: insertCounter, readCounter: readCounter}
 	return sync
 }
 
-func FullSync(config Config, pg *sqlx.DB, mongo *mgo.Session) {
-	sync := NewSynchronizer(config, pg, mongo)
+// SyncSelection maps the db.collection keys a full sync is limited to onto
+// an optional Mongo query for each. A nil SyncSelection syncs everything.
+type SyncSelection map[string]interface{}
+
+// Filter returns the query for key and whether key should be synced
+func (s SyncSelection) Filter(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, true
+	}
+	filter, ok := s[key]
+	return filter, ok
+}
+
+// ParseSyncSelection builds the SyncSelection for -full-sync-collections, a
+// comma separated list of db.collection keys, and -full-sync-filter, a JSON
+// object of db.collection keys to Mongo queries in extended JSON. Filtered
+// collections are synced even when not listed.
+func ParseSyncSelection(config Config, collections string, filters string) (SyncSelection, error) {
+	if collections == "" && filters == "" {
+		return nil, nil
+	}
+	selection := SyncSelection{}
+	for _, key := range strings.Split(collections, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if !configHasFanKey(config, key) {
+			return nil, fmt.Errorf("-full-sync-collections %s is not a db.collection in config", key)
+		}
+		selection[key] = nil
+	}
+	if filters != "" {
+		var parsed map[string]interface{}
+		if err := bson.UnmarshalJSON([]byte(filters), &parsed); err != nil {
+			return nil, fmt.Errorf("Unable to parse -full-sync-filter: %s", err)
+		}
+		for key, filter := range parsed {
+			if !configHasFanKey(config, key) {
+				return nil, fmt.Errorf("-full-sync-filter %s is not a db.collection in config", key)
+			}
+			selection[key] = filter
+		}
+	}
+	if len(selection) == 0 {
+		return nil, nil
+	}
+	return selection, nil
+}
+
+func configHasFanKey(config Config, key string) bool {
+	for dbName, db := range config {
+		for collectionName := range db.Collections {
+			if createFanKey(dbName, collectionName) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func FullSync(config Config, pg *sqlx.DB, mongo *mgo.Session, env Env) {
+	selection, err := ParseSyncSelection(config, env.fullSyncCollections, env.fullSyncFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	progress, err := newSyncProgressStore(pg, env)
+	if err != nil {
+		log.Errorf("Unable to load full sync progress, syncing from the start: %s", err)
+	}
+	sync := NewSynchronizer(config, pg, mongo, env)
+	sync.selection = selection
+	sync.progress = progress
+	sync.readers = env.fullSyncReaders
+	sync.partitions = env.fullSyncPartitions
+	sync.bulkCopy = env.bulkCopy
+	sync.restart = env.fullSyncRestart
+	sync.appName = env.appName
+	sync.backoff = NewBackoff(env.retryAttempts, env.retryMaxBackoff)
 	wg.Add(2)
 	log.Debug("Starting writer")
 	go sync.Write()
@@ -150,4 +434,6 @@ func FullSync(config Config, pg *sqlx.DB, mongo *mgo.Session) {
 	go sync.Read()
 
 	wg.Wait()
+	sync.Reconcile(pg)
+	sync.Output.Close()
 }
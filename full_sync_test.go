@@ -1,6 +1,8 @@
 package moresql_test
 
 import (
+	"time"
+
 	m "github.com/zph/moresql"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
@@ -28,9 +30,9 @@ func (s *MySuite) TestBuildOpFromMongo(c *C) {
 	id := bson.ObjectId("123")
 	result["_id"] = id
 	result["name"] = "Alice"
-	db := m.DBResult{"user", "user", result}
+	db := m.DBResult{MongoDB: "user", Collection: "user", Data: result}
 	fields := BuildFields("_id", "name", "age")
-	coll := m.Collection{"user", "user", fields}
+	coll := m.Collection{Name: "user", PgTable: "user", Fields: fields}
 	op := m.BuildOpFromMgo([]string{"_id", "name", "age"}, db, coll)
 
 	c.Check(op.Id, Equals, id)
@@ -41,3 +43,52 @@ func (s *MySuite) TestBuildOpFromMongo(c *C) {
 		c.Check(val, Equals, nil)
 	}
 }
+
+func syncSelectionConfig() m.Config {
+	fields := BuildFields("_id")
+	return m.Config{
+		"app": m.DB{Collections: m.Collections{
+			"users":    m.Collection{Name: "users", PgTable: "users", Fields: fields},
+			"accounts": m.Collection{Name: "accounts", PgTable: "accounts", Fields: fields},
+		}},
+	}
+}
+
+func (s *MySuite) TestParseSyncSelectionDefaultsToEverything(c *C) {
+	selection, err := m.ParseSyncSelection(syncSelectionConfig(), "", "")
+	c.Assert(err, IsNil)
+	c.Check(selection, IsNil)
+	filter, ok := selection.Filter("app.users")
+	c.Check(ok, Equals, true)
+	c.Check(filter, IsNil)
+}
+
+func (s *MySuite) TestParseSyncSelectionCollections(c *C) {
+	selection, err := m.ParseSyncSelection(syncSelectionConfig(), "app.users, ", "")
+	c.Assert(err, IsNil)
+	_, ok := selection.Filter("app.users")
+	c.Check(ok, Equals, true)
+	_, ok = selection.Filter("app.accounts")
+	c.Check(ok, Equals, false)
+}
+
+func (s *MySuite) TestParseSyncSelectionFilters(c *C) {
+	selection, err := m.ParseSyncSelection(syncSelectionConfig(), "app.users", `{"app.accounts": {"created_at": {"$gte": {"$date": "2017-01-01T00:00:00Z"}}}}`)
+	c.Assert(err, IsNil)
+	filter, ok := selection.Filter("app.users")
+	c.Check(ok, Equals, true)
+	c.Check(filter, IsNil)
+	filter, ok = selection.Filter("app.accounts")
+	c.Check(ok, Equals, true)
+	created := filter.(map[string]interface{})["created_at"].(map[string]interface{})
+	c.Check(created["$gte"], FitsTypeOf, time.Time{})
+}
+
+func (s *MySuite) TestParseSyncSelectionRejectsUnknownCollections(c *C) {
+	_, err := m.ParseSyncSelection(syncSelectionConfig(), "app.missing", "")
+	c.Check(err, NotNil)
+	_, err = m.ParseSyncSelection(syncSelectionConfig(), "", `{"other.users": {}}`)
+	c.Check(err, NotNil)
+	_, err = m.ParseSyncSelection(syncSelectionConfig(), "", `{not json`)
+	c.Check(err, NotNil)
+}
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/Sirupsen/logrus v0.10.1-0.20160601113210-f3cfb454f4c2
+	github.com/antonmedv/expr v1.10.5
 	github.com/heroku/rollrus v0.0.0-20160824233412-d20e35b8f913
 	github.com/jmoiron/sqlx v0.0.0-20161209024531-cac998c4f095
 	github.com/lib/pq v0.0.0-20160511035104-ee1442bda7bd
@@ -15,7 +16,7 @@ require (
 	github.com/stvp/roll v0.0.0-20170116223130-ca202b60b260
 	github.com/thejerf/suture v2.0.0+incompatible
 	github.com/tidwall/gjson v0.0.0-20170526023918-c784c417818f
-	github.com/tidwall/match v1.0.1 // indirect
+	github.com/tidwall/match v1.0.1
 	golang.org/x/sys v0.0.0-20161214190518-d75a52659825
 	gopkg.in/check.v1 v1.0.0-20161208181325-20d25e280405
 	gopkg.in/mgo.v2 v2.0.0-20160818020120-3f83fa500528
@@ -0,0 +1,119 @@
+package moresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// HealthCheck is the outcome of one check reported by /healthz or /readyz
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Health checks the process for /healthz and /readyz. A zero threshold
+// disables its check. Staleness and checkpoint age are only checked
+// once tailing has started.
+type Health struct {
+	// Ping holds a connectivity check per dependency, ie mongo and postgres
+	Ping             map[string]func() error
+	Metrics          *Metrics
+	MaxLag           time.Duration
+	MaxIdle          time.Duration
+	MaxCheckpointAge time.Duration
+}
+
+// NewHealth builds the Health of this process from the thresholds in env
+func NewHealth(pg *sqlx.DB, session *mgo.Session, env Env) Health {
+	h := Health{
+		Ping: map[string]func() error{
+			"postgres": pg.Ping,
+			"mongo": func() error {
+				s := session.Copy()
+				defer s.Close()
+				return s.Ping()
+			},
+		},
+		Metrics: metrics,
+		MaxLag:  env.healthMaxLag,
+		MaxIdle: env.healthMaxIdle,
+	}
+	if env.checkpoint {
+		h.MaxCheckpointAge = env.healthMaxCheckpointAge
+	}
+	return h
+}
+
+func thresholdCheck(name string, value time.Duration, max time.Duration) HealthCheck {
+	c := HealthCheck{Name: name, OK: true, Value: value.String()}
+	if max > 0 && value > max {
+		c.OK = false
+		c.Error = fmt.Sprintf("exceeds %s", max)
+	}
+	return c
+}
+
+// Live reports whether the process is making progress. A wedged tailer
+// fails it so that it is restarted, an unreachable database does not.
+func (h Health) Live() []HealthCheck {
+	checks := []HealthCheck{}
+	if idle, _, ok := h.Metrics.Staleness(); ok {
+		checks = append(checks, thresholdCheck("last_op", idle, h.MaxIdle))
+	}
+	if h.MaxCheckpointAge > 0 {
+		if age, ok := h.Metrics.CheckpointAge(); ok {
+			checks = append(checks, thresholdCheck("checkpoint_age", age, h.MaxCheckpointAge))
+		}
+	}
+	return checks
+}
+
+// Ready adds connectivity and replication lag to Live, failing while
+// Postgres is not being kept up to date
+func (h Health) Ready() []HealthCheck {
+	var checks []HealthCheck
+	for _, name := range []string{"mongo", "postgres"} {
+		ping, ok := h.Ping[name]
+		if !ok {
+			continue
+		}
+		c := HealthCheck{Name: name, OK: true}
+		if err := ping(); err != nil {
+			c.OK = false
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+	if _, lag, ok := h.Metrics.Staleness(); ok {
+		checks = append(checks, thresholdCheck("replication_lag", lag, h.MaxLag))
+	}
+	return append(checks, h.Live()...)
+}
+
+// HealthHandler responds 200 when every check passes and 503 otherwise,
+// with the checks as JSON
+func HealthHandler(checks func() []HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := struct {
+			Status string        `json:"status"`
+			Checks []HealthCheck `json:"checks"`
+		}{Status: "ok", Checks: checks()}
+		for _, c := range report.Checks {
+			if !c.OK {
+				report.Status = "fail"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,102 @@
+package moresql_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.t
+}
+
+func healthWithClock() (m.Health, *clock) {
+	c := &clock{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	metrics := m.NewMetrics()
+	metrics.Now = c.Now
+	return m.Health{
+		Ping: map[string]func() error{
+			"mongo":    func() error { return nil },
+			"postgres": func() error { return nil },
+		},
+		Metrics:          metrics,
+		MaxLag:           time.Minute,
+		MaxIdle:          10 * time.Minute,
+		MaxCheckpointAge: 5 * time.Minute,
+	}, c
+}
+
+func failing(checks []m.HealthCheck) []string {
+	var names []string
+	for _, check := range checks {
+		if !check.OK {
+			names = append(names, check.Name)
+		}
+	}
+	return names
+}
+
+func (s *MySuite) TestHealthBeforeTailing(c *C) {
+	h, _ := healthWithClock()
+	c.Check(h.Live(), HasLen, 0)
+	c.Check(failing(h.Ready()), IsNil)
+}
+
+func (s *MySuite) TestHealthLagAndStaleness(c *C) {
+	h, clock := healthWithClock()
+	h.Metrics.Tailing()
+	clock.t = clock.t.Add(time.Second)
+	h.Metrics.Lag(500)
+	h.Metrics.CheckpointSaved()
+	c.Check(failing(h.Ready()), IsNil)
+
+	h.Metrics.Lag(int64(2 * time.Minute / time.Millisecond))
+	c.Check(failing(h.Live()), IsNil)
+	c.Check(failing(h.Ready()), DeepEquals, []string{"replication_lag"})
+
+	clock.t = clock.t.Add(time.Second)
+	h.Metrics.Lag(500)
+	clock.t = clock.t.Add(6 * time.Minute)
+	c.Check(failing(h.Live()), DeepEquals, []string{"checkpoint_age"})
+
+	clock.t = clock.t.Add(6 * time.Minute)
+	c.Check(failing(h.Live()), DeepEquals, []string{"last_op", "checkpoint_age"})
+}
+
+func (s *MySuite) TestHealthQuietOplogKeepsCheckpointFresh(c *C) {
+	h, clock := healthWithClock()
+	h.MaxIdle = 0
+	h.Metrics.Tailing()
+	clock.t = clock.t.Add(time.Hour)
+	c.Check(failing(h.Live()), IsNil)
+}
+
+func (s *MySuite) TestHealthPingFailure(c *C) {
+	h, _ := healthWithClock()
+	h.Ping["postgres"] = func() error { return errors.New("connection refused") }
+	c.Check(failing(h.Ready()), DeepEquals, []string{"postgres"})
+	c.Check(failing(h.Live()), IsNil)
+}
+
+func (s *MySuite) TestHealthHandler(c *C) {
+	h, _ := healthWithClock()
+	rec := httptest.NewRecorder()
+	m.HealthHandler(h.Ready).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rec.Body.String(), `"status":"ok"`), Equals, true)
+
+	h.Ping["mongo"] = func() error { return errors.New("no reachable servers") }
+	rec = httptest.NewRecorder()
+	m.HealthHandler(h.Ready).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	c.Check(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(strings.Contains(rec.Body.String(), `"error":"no reachable servers"`), Equals, true)
+}
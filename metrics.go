@@ -0,0 +1,299 @@
+package moresql
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// lagBuckets are the upper bounds in seconds of the replication lag histogram
+var lagBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// sqlBuckets are the upper bounds in seconds of the SQL latency histogram
+var sqlBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics is shared by the tailer, full sync and sinks of this process
+var metrics = NewMetrics()
+
+// labels is a set of label values in the order of a metric's label names
+type labels []string
+
+func (l labels) key() string {
+	return strings.Join(l, "\xff")
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics collects counters, histograms and gauges exposed at /metrics
+// in the Prometheus text format
+type Metrics struct {
+	sync.Mutex
+	ops          map[string]labels
+	opCounts     map[string]uint64
+	errors       map[string]uint64
+	exprErrors   map[string]uint64
+	lag          *histogram
+	sql          map[string]*histogram
+	checkpointAt time.Time
+	tailingSince time.Time
+	lastOpAt     time.Time
+	lastLag      time.Duration
+	backlog      func() map[string]int
+	// Now is the clock used for ages and durations
+	Now func() time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:        make(map[string]labels),
+		opCounts:   make(map[string]uint64),
+		errors:     make(map[string]uint64),
+		exprErrors: make(map[string]uint64),
+		lag:        &histogram{counts: make([]uint64, len(lagBuckets))},
+		sql:        make(map[string]*histogram),
+		Now:        time.Now,
+	}
+}
+
+// Op counts an insert, update or delete applied to collection, a db.collection namespace
+func (m *Metrics) Op(collection string, operation string) {
+	l := labels{collection, operation}
+	m.Lock()
+	m.ops[l.key()] = l
+	m.opCounts[l.key()]++
+	m.Unlock()
+}
+
+// Error counts an op on collection which could not be applied
+func (m *Metrics) Error(collection string) {
+	m.Lock()
+	m.errors[collection]++
+	m.Unlock()
+}
+
+// ExpressionError counts a computed field whose expression failed,
+// returning the number of failures of field so far
+func (m *Metrics) ExpressionError(field string) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	m.exprErrors[field]++
+	return m.exprErrors[field]
+}
+
+// Lag records the replication lag of an op as it is processed
+func (m *Metrics) Lag(ms int64) {
+	m.Lock()
+	m.lag.observe(lagBuckets, float64(ms)/1000)
+	m.lastOpAt = m.Now()
+	m.lastLag = time.Duration(ms) * time.Millisecond
+	m.Unlock()
+}
+
+// Tailing records that the tailer started, staleness
+// and checkpoint age are measured from then at the earliest
+func (m *Metrics) Tailing() {
+	m.Lock()
+	m.tailingSince = m.Now()
+	m.Unlock()
+}
+
+// Staleness is the time since an op was last processed and the lag of that
+// op, false until tailing has started
+func (m *Metrics) Staleness() (idle time.Duration, lag time.Duration, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.tailingSince.IsZero() {
+		return 0, 0, false
+	}
+	last := m.lastOpAt
+	if last.Before(m.tailingSince) {
+		last = m.tailingSince
+	}
+	return m.Now().Sub(last), m.lastLag, true
+}
+
+// SQL records the duration of a statement of kind started at start
+func (m *Metrics) SQL(kind string, start time.Time) {
+	d := m.Now().Sub(start).Seconds()
+	m.Lock()
+	h, ok := m.sql[kind]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(sqlBuckets))}
+		m.sql[kind] = h
+	}
+	h.observe(sqlBuckets, d)
+	m.Unlock()
+}
+
+// CheckpointSaved records that a checkpoint was just persisted
+func (m *Metrics) CheckpointSaved() {
+	m.Lock()
+	m.checkpointAt = m.Now()
+	m.Unlock()
+}
+
+// CheckpointAge is the time since a checkpoint was last saved, or since
+// tailing started when none has been saved since. It is zero while no op
+// has been processed after that, as a quiet oplog has nothing to save.
+// False when neither happened.
+func (m *Metrics) CheckpointAge() (time.Duration, bool) {
+	m.Lock()
+	defer m.Unlock()
+	last := m.checkpointAt
+	if last.Before(m.tailingSince) {
+		last = m.tailingSince
+	}
+	if last.IsZero() {
+		return 0, false
+	}
+	if !m.lastOpAt.After(last) {
+		return 0, true
+	}
+	return m.Now().Sub(last), true
+}
+
+// Backlog sets the function reporting the number of ops queued per collection
+func (m *Metrics) Backlog(fn func() map[string]int) {
+	m.Lock()
+	m.backlog = fn
+	m.Unlock()
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatLabels(names []string, values labels) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, escapeLabel(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name string, names []string, values labels, buckets []float64, h *histogram) {
+	bucketNames := append(append([]string(nil), names...), "le")
+	for i, b := range buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketNames, append(append(labels(nil), values...), formatFloat(b))), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketNames, append(append(labels(nil), values...), "+Inf")), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(names, values), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(names, values), h.count)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Expose writes every metric in the Prometheus text exposition format
+func (m *Metrics) Expose(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	writeHeader(w, "moresql_ops_total", "counter", "Operations applied to Postgres by collection and operation.")
+	for _, k := range sortedKeys(m.opCounts) {
+		fmt.Fprintf(w, "moresql_ops_total%s %d\n", formatLabels([]string{"collection", "operation"}, m.ops[k]), m.opCounts[k])
+	}
+
+	writeHeader(w, "moresql_errors_total", "counter", "Operations which could not be applied and were dead lettered, by collection.")
+	for _, k := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "moresql_errors_total%s %d\n", formatLabels([]string{"collection"}, labels{k}), m.errors[k])
+	}
+
+	writeHeader(w, "moresql_expression_errors_total", "counter", "Computed fields whose expression failed and were stored as NULL, by field.")
+	for _, k := range sortedKeys(m.exprErrors) {
+		fmt.Fprintf(w, "moresql_expression_errors_total%s %d\n", formatLabels([]string{"field"}, labels{k}), m.exprErrors[k])
+	}
+
+	writeHeader(w, "moresql_replication_lag_seconds", "histogram", "Time between an operation in Mongo and it being applied.")
+	writeHistogram(w, "moresql_replication_lag_seconds", nil, nil, lagBuckets, m.lag)
+
+	writeHeader(w, "moresql_sql_duration_seconds", "histogram", "Duration of SQL statements by kind.")
+	var kinds []string
+	for k := range m.sql {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		writeHistogram(w, "moresql_sql_duration_seconds", []string{"kind"}, labels{k}, sqlBuckets, m.sql[k])
+	}
+
+	if m.backlog != nil {
+		writeHeader(w, "moresql_backlog", "gauge", "Operations read from Mongo and waiting for a worker, by collection.")
+		backlog := m.backlog()
+		var collections []string
+		for c := range backlog {
+			collections = append(collections, c)
+		}
+		sort.Strings(collections)
+		for _, c := range collections {
+			fmt.Fprintf(w, "moresql_backlog%s %d\n", formatLabels([]string{"collection"}, labels{c}), backlog[c])
+		}
+	}
+
+	if !m.checkpointAt.IsZero() {
+		writeHeader(w, "moresql_checkpoint_age_seconds", "gauge", "Time since the last checkpoint was saved.")
+		fmt.Fprintf(w, "moresql_checkpoint_age_seconds %s\n", formatFloat(m.Now().Sub(m.checkpointAt).Seconds()))
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Expose(w)
+}
+
+// Monitor serves expvar at /debug/vars, Prometheus metrics at /metrics
+// and health checks at /healthz and /readyz. The admin API is served
+// under /admin/ when adminToken is set.
+func Monitor(addr string, health Health, adminToken string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/healthz", HealthHandler(health.Live))
+	mux.Handle("/readyz", HealthHandler(health.Ready))
+	if adminToken != "" {
+		mux.Handle("/admin/", admin.Handler(adminToken))
+	}
+	log.Infof("Serving monitoring endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Unable to serve monitoring endpoints: %s", err.Error())
+	}
+}
@@ -0,0 +1,64 @@
+package moresql_test
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func expose(metrics *m.Metrics) string {
+	var b bytes.Buffer
+	metrics.Expose(&b)
+	return b.String()
+}
+
+func (s *MySuite) TestMetricsCounters(c *C) {
+	metrics := m.NewMetrics()
+	metrics.Op("app.users", "insert")
+	metrics.Op("app.users", "insert")
+	metrics.Op("app.users", "delete")
+	metrics.Error(`app."quoted"`)
+	c.Check(metrics.ExpressionError("display_name"), Equals, uint64(1))
+	c.Check(metrics.ExpressionError("display_name"), Equals, uint64(2))
+	out := expose(metrics)
+	c.Check(out, Matches, `(?s).*# TYPE moresql_ops_total counter\n`+
+		`moresql_ops_total\{collection="app.users",operation="delete"\} 1\n`+
+		`moresql_ops_total\{collection="app.users",operation="insert"\} 2\n.*`)
+	c.Check(strings.Contains(out, `moresql_errors_total{collection="app.\"quoted\""} 1`), Equals, true)
+	c.Check(strings.Contains(out, `moresql_expression_errors_total{field="display_name"} 2`), Equals, true)
+	c.Check(strings.Contains(out, "moresql_checkpoint_age_seconds"), Equals, false)
+	c.Check(strings.Contains(out, "moresql_backlog"), Equals, false)
+}
+
+func (s *MySuite) TestMetricsHistograms(c *C) {
+	metrics := m.NewMetrics()
+	metrics.Lag(250)
+	metrics.Lag(45000)
+	metrics.SQL("upsert", time.Now())
+	out := expose(metrics)
+	c.Check(strings.Contains(out, `moresql_replication_lag_seconds_bucket{le="0.1"} 0`), Equals, true)
+	c.Check(strings.Contains(out, `moresql_replication_lag_seconds_bucket{le="0.5"} 1`), Equals, true)
+	c.Check(strings.Contains(out, `moresql_replication_lag_seconds_bucket{le="60"} 2`), Equals, true)
+	c.Check(strings.Contains(out, `moresql_replication_lag_seconds_bucket{le="+Inf"} 2`), Equals, true)
+	c.Check(strings.Contains(out, "moresql_replication_lag_seconds_sum 45.25\n"), Equals, true)
+	c.Check(strings.Contains(out, "moresql_replication_lag_seconds_count 2\n"), Equals, true)
+	c.Check(strings.Contains(out, `moresql_sql_duration_seconds_bucket{kind="upsert",le="+Inf"} 1`), Equals, true)
+	c.Check(strings.Contains(out, `moresql_sql_duration_seconds_count{kind="upsert"} 1`), Equals, true)
+}
+
+func (s *MySuite) TestMetricsGauges(c *C) {
+	metrics := m.NewMetrics()
+	metrics.Backlog(func() map[string]int { return map[string]int{"app.users": 3, "app.accounts": 0} })
+	_, ok := metrics.CheckpointAge()
+	c.Check(ok, Equals, false)
+	metrics.CheckpointSaved()
+	age, ok := metrics.CheckpointAge()
+	c.Check(ok, Equals, true)
+	c.Check(age < time.Second, Equals, true)
+	out := expose(metrics)
+	c.Check(strings.Contains(out, "moresql_backlog{collection=\"app.accounts\"} 0\nmoresql_backlog{collection=\"app.users\"} 3\n"), Equals, true)
+	c.Check(strings.Contains(out, "moresql_checkpoint_age_seconds "), Equals, true)
+}
@@ -0,0 +1,190 @@
+package moresql
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+)
+
+// MigrationPlan holds the differences between Postgres and the
+// configuration, in the order the fixes must be applied. Types are
+// reported only, as changing a column type may fail or lose data.
+type MigrationPlan struct {
+	Schemas []TableColumn
+	Tables  []TableColumn
+	Columns []TableColumn
+	Indexes []TableColumn
+	Types   []TableColumn
+}
+
+// Empty is true when Postgres already matches the configuration
+func (p MigrationPlan) Empty() bool {
+	return len(p.Schemas) == 0 && len(p.Tables) == 0 && len(p.Columns) == 0 && len(p.Indexes) == 0 && len(p.Types) == 0
+}
+
+// Statements returns the DDL which applies the plan, excluding Types
+func (p MigrationPlan) Statements() []string {
+	var statements []string
+	for _, t := range p.Schemas {
+		statements = append(statements, t.createSchema())
+	}
+	for _, t := range p.Tables {
+		statements = append(statements, t.createTable())
+	}
+	for _, t := range p.Columns {
+		statements = append(statements, t.Solution)
+	}
+	for _, t := range p.Indexes {
+		statements = append(statements, t.Solution)
+	}
+	return statements
+}
+
+// Report logs each difference found
+func (p MigrationPlan) Report() {
+	for _, group := range [][]TableColumn{p.Schemas, p.Tables, p.Columns, p.Indexes, p.Types} {
+		for _, v := range group {
+			log.Printf("Table %s.%s Column: %s, Error: %s", v.Schema, v.Table, v.Column, v.Message)
+		}
+	}
+}
+
+// hasSchema is true when schema has already been found missing
+func (p MigrationPlan) hasSchema(schema string) bool {
+	for _, t := range p.Schemas {
+		if t.Schema == schema {
+			return true
+		}
+	}
+	return false
+}
+
+// Migrate creates missing schemas, tables, columns and _id unique indexes inside
+// a single transaction. With dryRun the plan is only logged.
+func (c *Commands) Migrate(config Config, pg *sqlx.DB, dryRun bool) error {
+	plan, err := c.PlanMigration(config, pg)
+	if err != nil {
+		return err
+	}
+	if plan.Empty() {
+		log.Info("Migration not required. Postgres tables look good.")
+		return nil
+	}
+	plan.Report()
+	for _, t := range plan.Types {
+		log.Warnf("Column type is not migrated automatically, review and apply: %s", t.Solution)
+	}
+	statements := plan.Statements()
+	if len(statements) == 0 {
+		return nil
+	}
+	if dryRun {
+		log.Info("Dry run, the following SQL would be applied:")
+		for _, s := range statements {
+			log.Info(s)
+		}
+		return nil
+	}
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		log.Infof("Applying: %s", s)
+		if _, err := tx.Exec(s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("Migration applied %d statement(s)", len(statements))
+	return nil
+}
+
+// postgresTypeAliases maps alternate spellings to the name format_type reports
+var postgresTypeAliases = map[string]string{
+	"int":         "integer",
+	"int4":        "integer",
+	"serial":      "integer",
+	"serial4":     "integer",
+	"int8":        "bigint",
+	"bigserial":   "bigint",
+	"serial8":     "bigint",
+	"int2":        "smallint",
+	"smallserial": "smallint",
+	"serial2":     "smallint",
+	"bool":        "boolean",
+	"float8":      "double precision",
+	"float4":      "real",
+	"decimal":     "numeric",
+	"varchar":     "character varying",
+	"char":        "character",
+	"bpchar":      "character",
+	"timestamp":   "timestamp without time zone",
+	"timestamptz": "timestamp with time zone",
+	"time":        "time without time zone",
+	"timetz":      "time with time zone",
+	"varbit":      "bit varying",
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// NormalizePostgresType rewrites a type name as format_type would report it,
+// ie TIMESTAMPTZ becomes timestamp with time zone and VARCHAR(10) becomes
+// character varying(10)
+func NormalizePostgresType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	t = whitespace.ReplaceAllString(t, " ")
+	t = strings.Replace(t, " (", "(", -1)
+	t = strings.Replace(t, ", ", ",", -1)
+	if strings.HasSuffix(t, "[]") {
+		return NormalizePostgresType(strings.TrimSuffix(t, "[]")) + "[]"
+	}
+	name, modifier := t, ""
+	if i := strings.Index(t, "("); i >= 0 {
+		if j := strings.Index(t[i:], ")"); j >= 0 {
+			name, modifier = t[:i]+t[i+j+1:], t[i:i+j+1]
+		}
+	}
+	if alias, ok := postgresTypeAliases[name]; ok {
+		name = alias
+	}
+	// format_type places the modifier before "with/without time zone"
+	for _, suffix := range []string{" with time zone", " without time zone"} {
+		if strings.HasSuffix(name, suffix) && modifier != "" {
+			return strings.TrimSuffix(name, suffix) + modifier + suffix
+		}
+	}
+	if name == "character" && modifier == "" {
+		modifier = "(1)"
+	}
+	return name + modifier
+}
+
+// PostgresTypesEqual compares a configured type with one from the catalog
+func PostgresTypesEqual(configured, actual string) bool {
+	return NormalizePostgresType(configured) == NormalizePostgresType(actual)
+}
+
+func sortedDBNames(config Config) []string {
+	var names []string
+	for k := range config {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedCollectionNames(db DB) []string {
+	var names []string
+	for k := range db.Collections {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
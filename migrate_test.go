@@ -0,0 +1,66 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestMigrationPlanEmpty(c *C) {
+	c.Check(m.MigrationPlan{}.Empty(), Equals, true)
+	c.Check(m.MigrationPlan{}.Statements(), IsNil)
+	c.Check(m.MigrationPlan{Schemas: []m.TableColumn{{Schema: "analytics"}}}.Empty(), Equals, false)
+}
+
+func (s *MySuite) TestMigrationPlanStatementsOrder(c *C) {
+	plan := m.MigrationPlan{
+		Indexes: []m.TableColumn{{Schema: "public", Table: "users", Column: "id", Solution: "INDEX"}},
+		Columns: []m.TableColumn{{Schema: "public", Table: "users", Column: "name", Solution: "COLUMN"}},
+		Tables:  []m.TableColumn{{Schema: "analytics", Table: "users"}},
+		Schemas: []m.TableColumn{{Schema: "analytics"}},
+	}
+	c.Check(plan.Empty(), Equals, false)
+	c.Check(plan.Statements(), DeepEquals, []string{
+		`CREATE SCHEMA IF NOT EXISTS "analytics";`,
+		`CREATE TABLE IF NOT EXISTS "analytics"."users"();`,
+		"COLUMN",
+		"INDEX",
+	})
+}
+
+func (s *MySuite) TestNormalizePostgresType(c *C) {
+	cases := map[string]string{
+		"TEXT":                        "text",
+		"  text ":                     "text",
+		"TIMESTAMP WITH TIME ZONE":    "timestamp with time zone",
+		"timestamptz":                 "timestamp with time zone",
+		"timestamp":                   "timestamp without time zone",
+		"timestamptz(3)":              "timestamp(3) with time zone",
+		"timestamp(3) with time zone": "timestamp(3) with time zone",
+		"int":                         "integer",
+		"INT8":                        "bigint",
+		"bool":                        "boolean",
+		"VARCHAR(255)":                "character varying(255)",
+		"decimal(10, 2)":              "numeric(10,2)",
+		"char":                        "character(1)",
+		"int[]":                       "integer[]",
+		"jsonb":                       "jsonb",
+		"double   precision":          "double precision",
+	}
+	for input, expected := range cases {
+		c.Check(m.NormalizePostgresType(input), Equals, expected, Commentf("input %q", input))
+	}
+}
+
+func (s *MySuite) TestPostgresTypesEqual(c *C) {
+	c.Check(m.PostgresTypesEqual("TIMESTAMPTZ", "timestamp with time zone"), Equals, true)
+	c.Check(m.PostgresTypesEqual("text", "character varying"), Equals, false)
+	c.Check(m.PostgresTypesEqual("timestamp", "timestamp with time zone"), Equals, false)
+}
+
+func (s *MySuite) TestMigrationPlanExcludesTypeChanges(c *C) {
+	plan := m.MigrationPlan{
+		Types: []m.TableColumn{{Schema: "public", Table: "users", Column: "age", Solution: "ALTER"}},
+	}
+	c.Check(plan.Empty(), Equals, false)
+	c.Check(plan.Statements(), IsNil)
+}
@@ -2,7 +2,6 @@ package moresql
 
 import (
 	"flag"
-	"net/http"
 	"sync"
 	"time"
 
@@ -39,18 +38,44 @@ func Run() {
 		c.ValidateTablesAndColumns(config, pg)
 	}
 
+	if env.migrate || env.migrateDryRun {
+		if err := c.Migrate(config, pg, env.migrateDryRun); err != nil {
+			log.Fatalf("Migration failed, no changes were applied: %s", err.Error())
+		}
+	}
+
+	if env.fullSyncStatus {
+		FullSyncStatus(pg, env)
+	}
+
+	if env.postgresOnly() {
+		return
+	}
+
+	if err := CompileExpressions(config); err != nil {
+		log.Fatal(err)
+	}
+
 	session := GetMongoConnection(env)
 	defer session.Close()
 	log.Info("Connected to postgres")
 	log.Info("Connected to mongo")
 
 	if env.monitor {
-		go http.ListenAndServe(":1234", nil)
+		go Monitor(env.monitorAddr, NewHealth(pg, session, env), env.adminToken)
 	}
 
+	EnsureDeadLettersTable(pg, env.metadataSchema)
+
 	switch {
+	case env.replayDeadLetters:
+		ReplayDeadLetters(config, pg, env)
+	case env.verify:
+		Verify(config, pg, session, env)
+	case env.bootstrap:
+		Bootstrap(config, pg, session, env)
 	case env.sync:
-		FullSync(config, pg, session)
+		FullSync(config, pg, session, env)
 	case env.tail:
 		Tail(config, pg, session, env)
 	default:
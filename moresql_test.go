@@ -88,3 +88,124 @@ func (s *MySuite) TestBuildDeleteStatement(c *C) {
 	expected := `DELETE FROM "categories" WHERE "id" = :_id;`
 	c.Check(sql, Equals, expected)
 }
+
+func (s *MySuite) TestBuildBatchUpsertStatement(c *C) {
+	mongo := m.Mongo{"_id", "id"}
+	p := m.Postgres{"id", "text"}
+	f := m.Field{mongo, p}
+	f2 := m.Field{m.Mongo{"count", "text"}, m.Postgres{"count", "text"}}
+	fields := m.Fields{"_id": f, "count": f2}
+	collection := m.Collection{
+		Name:    "categories",
+		PgTable: "categories",
+		Fields:  fields}
+	o := m.Statement{collection}
+	sql := o.BuildBatchUpsert(2)
+	expected := `INSERT INTO "categories" ("id", "count")
+VALUES ($1, $2),
+($3, $4)
+ON CONFLICT ("id")
+DO UPDATE SET "count" = EXCLUDED."count";`
+	c.Check(sql, Equals, expected)
+
+	rows := []map[string]interface{}{
+		{"id": "1", "count": 10},
+		{"id": "2", "count": nil},
+	}
+	c.Check(o.BatchUpsertArgs(rows), DeepEquals, []interface{}{"1", 10, "2", nil})
+	c.Check(o.BatchRowLimit(), Equals, 32767)
+}
+
+func (s *MySuite) TestBuildBatchDeleteStatement(c *C) {
+	mongo := m.Mongo{"_id", "id"}
+	p := m.Postgres{"id", "id"}
+	f := m.Field{mongo, p}
+	fields := m.Fields{"_id": f}
+	collection := m.Collection{
+		Name:    "categories",
+		PgTable: "categories",
+		Fields:  fields}
+	o := m.Statement{collection}
+	sql := o.BuildBatchDelete(3)
+	expected := `DELETE FROM "categories" WHERE "id" IN ($1, $2, $3);`
+	c.Check(sql, Equals, expected)
+
+	rows := []map[string]interface{}{{"_id": "1"}, {"_id": "2"}, {"_id": "3"}}
+	c.Check(o.BatchDeleteArgs(rows), DeepEquals, []interface{}{"1", "2", "3"})
+}
+
+func (s *MySuite) TestBuildUpsertStatementWithSchema(c *C) {
+	fields := m.Fields{
+		"_id":   m.Field{m.Mongo{"_id", "id"}, m.Postgres{"id", "text"}},
+		"count": m.Field{m.Mongo{"count", "text"}, m.Postgres{"count", "text"}},
+	}
+	collection := m.Collection{
+		Name:     "categories",
+		PgTable:  "categories_in_pg",
+		PgSchema: "analytics",
+		Fields:   fields}
+	o := m.Statement{collection}
+
+	c.Check(o.BuildUpsert(), Equals, `INSERT INTO "analytics"."categories_in_pg" ("id", "count")
+VALUES (:id, :count)
+ON CONFLICT ("id")
+DO UPDATE SET "count" = :count;`)
+	c.Check(o.BuildDelete(), Equals, `DELETE FROM "analytics"."categories_in_pg" WHERE "id" = :_id;`)
+}
+
+func (s *MySuite) TestBuildStagingStatements(c *C) {
+	fields := m.Fields{
+		"_id":   m.Field{m.Mongo{"_id", "id"}, m.Postgres{"id", "text"}},
+		"count": m.Field{m.Mongo{"count", "text"}, m.Postgres{"count", "text"}},
+	}
+	collection := m.Collection{
+		Name:     "categories",
+		PgTable:  "categories",
+		PgSchema: "analytics",
+		Fields:   fields}
+	o := m.Statement{collection}
+	c.Check(o.BuildCreateStaging(), Equals, `CREATE TEMP TABLE "moresql_staging" (LIKE "analytics"."categories" INCLUDING DEFAULTS) ON COMMIT DROP;`)
+	c.Check(o.BuildMergeStaging(), Equals, `INSERT INTO "analytics"."categories" ("id", "count")
+SELECT "id", "count" FROM "moresql_staging"
+ON CONFLICT ("id")
+DO UPDATE SET "count" = EXCLUDED."count";`)
+}
+
+func (s *MySuite) TestBuildVerifyStatements(c *C) {
+	fields := m.Fields{
+		"_id":   m.Field{m.Mongo{"_id", "id"}, m.Postgres{"id", "text"}},
+		"count": m.Field{m.Mongo{"count", "text"}, m.Postgres{"count", "text"}},
+	}
+	collection := m.Collection{
+		Name:     "categories",
+		PgTable:  "categories",
+		PgSchema: "analytics",
+		Fields:   fields}
+	o := m.Statement{collection}
+	row := `CASE WHEN "id" IS NULL THEN 'N' ELSE 'V' || length("id"::text) || ':' || "id"::text END || ` +
+		`CASE WHEN "count" IS NULL THEN 'N' ELSE 'V' || length("count"::text) || ':' || "count"::text END`
+	c.Check(o.BuildVerifyRows(2), Equals, `SELECT "id"::text AS id, `+row+` AS doc FROM "analytics"."categories" WHERE "id" IN ($1, $2);`)
+	c.Check(o.BuildVerifyRange(true), Equals, `SELECT count(*) AS count, coalesce(md5(string_agg(row, '' ORDER BY row COLLATE "C")), '') AS digest FROM (SELECT `+row+` AS row FROM "analytics"."categories" WHERE "id" COLLATE "C" >= $1 AND "id" COLLATE "C" < $2) AS rows;`)
+	c.Check(o.BuildVerifyRange(false), Matches, `.* WHERE "id" COLLATE "C" >= \$1\) AS rows;`)
+	c.Check(o.BuildCount(), Equals, `SELECT count(*) FROM "analytics"."categories";`)
+}
+
+func (s *MySuite) TestBuildBatchInsertStatement(c *C) {
+	fields := m.Fields{
+		"title":     m.Field{m.Mongo{"title", "text"}, m.Postgres{"title", "text"}},
+		"author_id": m.Field{m.Mongo{"author_id", ""}, m.Postgres{"author_id", "text"}},
+	}
+	collection := m.Collection{
+		Name:    "authors.books",
+		PgTable: "author_books",
+		Fields:  fields}
+	o := m.Statement{collection}
+	sql := o.BuildBatchInsert(2)
+	expected := `INSERT INTO "author_books" ("author_id", "title")
+VALUES ($1, $2),
+($3, $4);`
+	c.Check(sql, Equals, expected)
+
+	sql = o.BuildBatchDeleteBy(m.Postgres{Name: "author_id"}, 2)
+	c.Check(sql, Equals, `DELETE FROM "author_books" WHERE "author_id" IN ($1, $2);`)
+}
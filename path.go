@@ -0,0 +1,144 @@
+package moresql
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/match"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExtractPath finds the value at path within a document as decoded from
+// BSON and normalizes it by NormalizeBSON, copying only the value found
+// rather than normalizing or marshalling the whole document. It follows
+// gjson's path syntax: keys separated by dots, '*' and '?' wildcards in keys, '\' escaping
+// a dot or wildcard, array indexes, '#' for the length of an array and '#.'
+// to collect a path from every element of an array. Paths with gjson queries,
+// ie 'friends.#[last=="Murphy"].first', are answered by gjson itself.
+func ExtractPath(doc interface{}, path string) (interface{}, bool) {
+	v, ok := extractRaw(doc, path)
+	if !ok {
+		return nil, false
+	}
+	return NormalizeBSON(v), true
+}
+
+// extractRaw finds the value at path as ExtractPath does, without
+// normalizing it
+func extractRaw(doc interface{}, path string) (interface{}, bool) {
+	if strings.Contains(path, "#[") {
+		return extractPathWithGjson(doc, path)
+	}
+	return extractPath(doc, path)
+}
+
+func extractPath(v interface{}, path string) (interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return extractFromObject(t, path)
+	case bson.M:
+		return extractFromObject(t, path)
+	case bson.D:
+		// Map copies the top level only, later keys win as in NormalizeBSON
+		return extractFromObject(t.Map(), path)
+	case []interface{}:
+		return extractFromArray(t, path)
+	}
+	return nil, false
+}
+
+// splitObjectPath returns the first key of path with escapes removed, whether
+// it holds wildcards, the remaining path and whether there is one
+func splitObjectPath(path string) (part string, wild bool, rest string, more bool) {
+	var b []byte
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '.':
+			return string(b), wild, path[i+1:], true
+		case '*', '?':
+			wild = true
+		case '\\':
+			i++
+			if i >= len(path) {
+				return string(b), wild, "", false
+			}
+		}
+		b = append(b, path[i])
+	}
+	return string(b), wild, "", false
+}
+
+func extractFromObject(obj map[string]interface{}, path string) (interface{}, bool) {
+	part, wild, rest, more := splitObjectPath(path)
+	if !wild {
+		v, ok := obj[part]
+		if !ok {
+			return nil, false
+		}
+		if !more {
+			return v, true
+		}
+		return extractPath(v, rest)
+	}
+	// The first matching key in key order wins, as for gjson reading
+	// a document marshalled by encoding/json
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !match.Match(k, part) {
+			continue
+		}
+		if !more {
+			return obj[k], true
+		}
+		if v, ok := extractPath(obj[k], rest); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func extractFromArray(arr []interface{}, path string) (interface{}, bool) {
+	part, rest, more := path, "", false
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		part, rest, more = path[:i], path[i+1:], true
+	}
+	if part == "#" {
+		if !more {
+			return len(arr), true
+		}
+		collected := []interface{}{}
+		for _, e := range arr {
+			if v, ok := extractPath(e, rest); ok {
+				collected = append(collected, v)
+			}
+		}
+		return collected, true
+	}
+	n, err := strconv.ParseUint(part, 10, 64)
+	if err != nil || n >= uint64(len(arr)) {
+		return nil, false
+	}
+	if !more {
+		return arr[n], true
+	}
+	return extractPath(arr[n], rest)
+}
+
+func extractPathWithGjson(doc interface{}, path string) (interface{}, bool) {
+	b, err := json.Marshal(NormalizeBSON(doc))
+	if err != nil {
+		return nil, false
+	}
+	r := gjson.GetBytes(b, path)
+	if !r.Exists() {
+		return nil, false
+	}
+	return r.Value(), true
+}
@@ -0,0 +1,150 @@
+package moresql_test
+
+import (
+	"encoding/json"
+
+	"github.com/rwynn/gtm"
+	"github.com/tidwall/gjson"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func pathCompatibilityDoc() map[string]interface{} {
+	return map[string]interface{}{
+		"_id":        bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1"),
+		"name":       bson.M{"first": "Tom", "last": "Anderson"},
+		"age":        37,
+		"score":      4.5,
+		"active":     true,
+		"deleted_at": nil,
+		"children":   []interface{}{"Sara", "Alex", "Jack"},
+		"friends": []interface{}{
+			bson.M{"first": "James", "last": "Murphy", "nets": []interface{}{"ig", "fb"}},
+			bson.M{"first": "Roger", "last": "Craig", "nets": []interface{}{"tw"}},
+			bson.M{"last": "Smith"},
+		},
+		"books": []interface{}{
+			bson.M{"product_id": 1, "title": "Dune", "tags": []interface{}{bson.M{"name": "scifi"}}},
+			bson.M{"product_id": 2, "title": "Emma", "tags": []interface{}{}},
+		},
+		"matrix":    []interface{}{[]interface{}{1, 2}, []interface{}{3}},
+		"fav.movie": "Deer Hunter",
+		"address":   bson.D{{Name: "home", Value: bson.M{"city": "Boston", "zip": "02134"}}, {Name: "work", Value: false}},
+		"aliases":   []interface{}{},
+	}
+}
+
+var compatibilityPaths = []string{
+	"_id",
+	"name",
+	"name.first",
+	"name.middle",
+	"name.first.letter",
+	"age",
+	"score",
+	"active",
+	"deleted_at",
+	"missing",
+	"children",
+	"children.#",
+	"children.0",
+	"children.2",
+	"children.3",
+	"children.x",
+	"child*.2",
+	"c?ildren.0",
+	"n*.last",
+	"*.city",
+	"friends.#",
+	"friends.1.last",
+	"friends.#.first",
+	"friends.#.last",
+	"friends.#.nets",
+	"friends.#.nets.0",
+	"friends.0.nets.1",
+	`friends.#[last=="Murphy"].first`,
+	`friends.#[last!="Murphy"]#.last`,
+	"books.#.product_id",
+	"books.#.tags.#.name",
+	"books.1.title",
+	"matrix.1.0",
+	`fav\.movie`,
+	"fav.movie",
+	"address.home",
+	"address.home.city",
+	"address.work",
+	"aliases.#",
+}
+
+func (s *MySuite) TestExtractPathMatchesGjson(c *C) {
+	doc := m.NormalizeBSON(pathCompatibilityDoc())
+	b, err := json.Marshal(doc)
+	c.Assert(err, IsNil)
+	for _, path := range compatibilityPaths {
+		expected := gjson.GetBytes(b, path)
+		actual, ok := m.ExtractPath(doc, path)
+		c.Check(ok, Equals, expected.Exists(), Commentf("path %s", path))
+		e, _ := json.Marshal(expected.Value())
+		a, _ := json.Marshal(actual)
+		c.Check(string(a), Equals, string(e), Commentf("path %s", path))
+	}
+}
+
+// gjson returns the last element rather than the length for '#' within '#.'
+func (s *MySuite) TestExtractPathNestedLengths(c *C) {
+	doc := m.NormalizeBSON(pathCompatibilityDoc())
+	v, ok := m.ExtractPath(doc, "friends.#.nets.#")
+	c.Check(ok, Equals, true)
+	c.Check(v, DeepEquals, []interface{}{2, 1})
+	v, ok = m.ExtractPath(doc, "matrix.#.#")
+	c.Check(ok, Equals, true)
+	c.Check(v, DeepEquals, []interface{}{2, 1})
+}
+
+func (s *MySuite) TestExtractPathWalksBSONDocuments(c *C) {
+	raw := pathCompatibilityDoc()
+	normalized := m.NormalizeBSON(raw)
+	for _, path := range compatibilityPaths {
+		expected, expectedOk := m.ExtractPath(normalized, path)
+		actual, ok := m.ExtractPath(raw, path)
+		c.Check(ok, Equals, expectedOk, Commentf("path %s", path))
+		c.Check(actual, DeepEquals, expected, Commentf("path %s", path))
+	}
+	doc := bson.D{{Name: "tags", Value: []interface{}{bson.D{{Name: "id", Value: bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1")}}}}}
+	v, ok := m.ExtractPath(doc, "tags.0")
+	c.Check(ok, Equals, true)
+	c.Check(v, DeepEquals, map[string]interface{}{"id": "58e52d2d6c5bd6a8f1c8a7a1"})
+}
+
+func (s *MySuite) TestExtractPathKeepsBSONTypes(c *C) {
+	doc := m.NormalizeBSON(map[string]interface{}{"n": map[string]interface{}{"big": int64(9007199254740993)}})
+	v, ok := m.ExtractPath(doc, "n.big")
+	c.Check(ok, Equals, true)
+	c.Check(v, Equals, int64(9007199254740993))
+}
+
+func (s *MySuite) TestSanitizeDataMatchesGjson(c *C) {
+	fields := m.Fields{}
+	for _, path := range compatibilityPaths {
+		fields[path] = m.Field{m.Mongo{path, "text"}, m.Postgres{path, "text"}}
+	}
+	data := pathCompatibilityDoc()
+	actual := m.SanitizeData(fields, &gtm.Op{Operation: "i", Data: data})
+	b, err := json.Marshal(m.NormalizeBSON(data))
+	c.Assert(err, IsNil)
+	for _, path := range compatibilityPaths {
+		r := gjson.GetBytes(b, path)
+		var expected interface{}
+		if r.Exists() {
+			expected = r.Value()
+			switch expected.(type) {
+			case map[string]interface{}, []interface{}:
+				expected = r.Raw
+			}
+		}
+		e, _ := json.Marshal(expected)
+		a, _ := json.Marshal(actual[path])
+		c.Check(string(a), Equals, string(e), Commentf("path %s", path))
+	}
+}
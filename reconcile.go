@@ -0,0 +1,256 @@
+package moresql
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// reconcileDelete removes rows whose document no longer exists in Mongo
+	reconcileDelete = "delete"
+	// reconcileReport only logs rows whose document no longer exists in Mongo
+	reconcileReport = "report"
+)
+
+// reconcileBatchSize is the number of ids checked against Mongo at a time
+const reconcileBatchSize = 1000
+
+// Reconcile finds rows of collections configured with reconcile whose _id no
+// longer exists in Mongo, then deletes or reports them. Collections synced
+// with a -full-sync-filter are skipped as rows outside the filter are expected.
+func (z *FullSyncer) Reconcile(pg *sqlx.DB) {
+	for _, t := range z.targets() {
+		coll := z.Config[t.db].Collections[t.name]
+		if coll.Reconcile == "" {
+			continue
+		}
+		key := createFanKey(t.db, t.name)
+		if filter, _ := z.selection.Filter(key); filter != nil {
+			log.WithField("collection", key).Warn("Skipping reconcile of collection synced with a filter")
+			continue
+		}
+		z.reconcileCollection(pg, t, coll)
+	}
+}
+
+func (z *FullSyncer) reconcileCollection(pg *sqlx.DB, t syncTarget, coll Collection) {
+	key := createFanKey(t.db, t.name)
+	o := Statement{coll}
+	var missing, unmapped, failed int
+	checked, err := z.findOrphans(pg, t, coll, func(id string, mapped bool) {
+		missing++
+		fields := log.Fields{"collection": key, "table": coll.PgTable, "id": id}
+		if !mapped {
+			unmapped++
+			log.WithFields(fields).Warn("Row has no matching Mongo document, not deleted as its id cannot be mapped back to a Mongo _id")
+			return
+		}
+		if coll.Reconcile == reconcileReport {
+			log.WithFields(fields).Warn("Row has no matching Mongo document")
+			return
+		}
+		data := map[string]interface{}{o.id().Mongo.Name: id}
+		if err := z.backoff.Retry(func() error { return z.Output.Delete(coll, data) }); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to delete row with no matching Mongo document")
+			failed++
+			return
+		}
+		log.WithFields(fields).Info("Deleted row with no matching Mongo document")
+	})
+	if err != nil {
+		log.Errorf("Unable to reconcile %s: %s", key, err)
+	}
+	log.WithFields(log.Fields{
+		"collection": key,
+		"mode":       coll.Reconcile,
+		"checked":    checked,
+		"missing":    missing,
+		"unmapped":   unmapped,
+		"failed":     failed,
+	}).Info("Finished reconcile")
+}
+
+// findOrphans calls visit with each id in the table of coll which has no
+// matching document in Mongo. mapped is false for ids which could not be
+// converted back into every value they may have had in Mongo, ie ids of
+// embedded documents, so their document may exist under another form.
+// Returns the number of ids checked.
+func (z *FullSyncer) findOrphans(pg *sqlx.DB, t syncTarget, coll Collection, visit func(id string, mapped bool)) (int, error) {
+	o := Statement{coll}
+	session := z.Mongo.Copy()
+	defer session.Close()
+	mongo := session.DB(t.db).C(t.name)
+	var checked int
+	var after string
+	for {
+		var ids []string
+		var err error
+		if checked == 0 {
+			err = pg.Select(&ids, o.BuildSelectIds(false), reconcileBatchSize)
+		} else {
+			err = pg.Select(&ids, o.BuildSelectIds(true), after, reconcileBatchSize)
+		}
+		if err != nil {
+			return checked, err
+		}
+		if len(ids) == 0 {
+			return checked, nil
+		}
+		checked += len(ids)
+		after = ids[len(ids)-1]
+
+		var candidates []interface{}
+		mapped := make([]bool, len(ids))
+		for i, id := range ids {
+			c, ok := MongoIdCandidates(id)
+			candidates = append(candidates, c...)
+			mapped[i] = ok
+		}
+		var docs []syncId
+		if err := mongo.Find(bson.M{"_id": bson.M{"$in": candidates}}).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+			// Without an answer from Mongo nothing can be considered missing
+			return checked, err
+		}
+		found := make(map[string]bool)
+		for _, d := range docs {
+			found[MongoIdKey(d.Id)] = true
+		}
+		for i, id := range ids {
+			if !matchesAny(found, id) {
+				visit(id, mapped[i])
+			}
+		}
+	}
+}
+
+func matchesAny(found map[string]bool, id string) bool {
+	candidates, _ := MongoIdCandidates(id)
+	for _, c := range candidates {
+		if found[MongoIdKey(c)] {
+			return true
+		}
+	}
+	return false
+}
+
+// decimalPattern matches numbers as rendered by Postgres and FormatMongoId
+var decimalPattern = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// idTimeLayouts are the forms a Date _id takes in a text, timestamp
+// or timestamptz column
+var idTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// MongoIdCandidates converts an id as stored in Postgres back into the values
+// it may have had in Mongo, reversing NormalizeBSON and ConvertMongoType:
+// ObjectIds are stored as hex or their raw bytes, UUIDs in canonical form,
+// numbers and Decimal128 as text, dates as timestamps and other binary data
+// as raw or base64 bytes. Returns false when id may also have been written
+// from a value which cannot be rebuilt, ie an embedded document as JSON.
+func MongoIdCandidates(id string) ([]interface{}, bool) {
+	candidates := []interface{}{id}
+	if bson.IsObjectIdHex(id) {
+		candidates = append(candidates, bson.ObjectIdHex(id))
+	} else if len(id) == 12 {
+		candidates = append(candidates, bson.ObjectId(id))
+	}
+	if decimalPattern.MatchString(id) {
+		if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+			candidates = append(candidates, i)
+		}
+		if f, err := strconv.ParseFloat(id, 64); err == nil {
+			candidates = append(candidates, f)
+		}
+		if d, err := bson.ParseDecimal128(id); err == nil {
+			candidates = append(candidates, d)
+		}
+	}
+	if b, ok := parseUUID(id); ok {
+		for _, kind := range []byte{0x04, 0x03} {
+			candidates = append(candidates, bson.Binary{Kind: kind, Data: b})
+		}
+	}
+	for _, layout := range idTimeLayouts {
+		if ts, err := time.Parse(layout, id); err == nil {
+			candidates = append(candidates, ts.UTC())
+			break
+		}
+	}
+	if id != "" {
+		candidates = append(candidates, bson.Binary{Kind: 0x00, Data: []byte(id)})
+		if b, err := base64.StdEncoding.DecodeString(id); err == nil {
+			candidates = append(candidates, bson.Binary{Kind: 0x00, Data: b})
+		}
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(id), &doc); err == nil {
+		switch doc.(type) {
+		case map[string]interface{}, []interface{}:
+			return candidates, false
+		}
+	}
+	return candidates, true
+}
+
+// MongoIdKey returns a key equal for _ids Mongo considers equal: numbers
+// compare by value whatever their type and dates to the millisecond
+func MongoIdKey(id interface{}) string {
+	var n *big.Rat
+	switch v := id.(type) {
+	case int:
+		n = big.NewRat(int64(v), 1)
+	case int32:
+		n = big.NewRat(int64(v), 1)
+	case int64:
+		n = big.NewRat(v, 1)
+	case float64:
+		n = new(big.Rat).SetFloat64(v)
+	case bson.Decimal128:
+		n, _ = new(big.Rat).SetString(v.String())
+	case time.Time:
+		return "date:" + strconv.FormatInt(v.UnixNano()/int64(time.Millisecond), 10)
+	}
+	if n != nil {
+		return "number:" + n.RatString()
+	}
+	b, err := bson.Marshal(bson.M{"_id": id})
+	if err != nil {
+		return fmt.Sprintf("%T:%v", id, id)
+	}
+	return string(b)
+}
+
+// FormatMongoId renders a Mongo _id as the text SanitizeData writes for it,
+// normalized by NormalizeBSON with documents encoded as JSON
+func FormatMongoId(id interface{}) string {
+	switch v := NormalizeBSON(id).(type) {
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(b)
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,79 @@
+package moresql_test
+
+import (
+	"time"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *MySuite) TestMongoIdCandidates(c *C) {
+	hex := "58e52d2d6c5bd6a8f1c8a7a1"
+	candidates, mapped := m.MongoIdCandidates(hex)
+	c.Check(mapped, Equals, true)
+	c.Check(hasIdCandidate(candidates, bson.ObjectIdHex(hex)), Equals, true)
+
+	candidates, _ = m.MongoIdCandidates("42")
+	c.Check(hasIdCandidate(candidates, 42), Equals, true)
+	c.Check(hasIdCandidate(candidates, "42"), Equals, true)
+
+	d, _ := bson.ParseDecimal128("4.50")
+	candidates, _ = m.MongoIdCandidates("4.5")
+	c.Check(hasIdCandidate(candidates, d), Equals, true)
+	c.Check(hasIdCandidate(candidates, 4.5), Equals, true)
+
+	uuid := []byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	candidates, mapped = m.MongoIdCandidates("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	c.Check(mapped, Equals, true)
+	c.Check(hasIdCandidate(candidates, bson.Binary{Kind: 0x04, Data: uuid}), Equals, true)
+	c.Check(hasIdCandidate(candidates, bson.Binary{Kind: 0x03, Data: uuid}), Equals, true)
+
+	date := time.Date(2017, 4, 5, 23, 30, 0, 0, time.UTC)
+	for _, id := range []string{"2017-04-05T23:30:00Z", "2017-04-05 23:30:00+00"} {
+		candidates, _ = m.MongoIdCandidates(id)
+		c.Check(hasIdCandidate(candidates, date), Equals, true, Commentf("id %s", id))
+	}
+
+	candidates, mapped = m.MongoIdCandidates(`{"a":1}`)
+	c.Check(mapped, Equals, false)
+	c.Check(hasIdCandidate(candidates, bson.D{{Name: "a", Value: 1}}), Equals, false)
+}
+
+func hasIdCandidate(candidates []interface{}, id interface{}) bool {
+	for _, candidate := range candidates {
+		if m.MongoIdKey(candidate) == m.MongoIdKey(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MySuite) TestMongoIdKey(c *C) {
+	d, _ := bson.ParseDecimal128("42.0")
+	c.Check(m.MongoIdKey(int32(42)), Equals, m.MongoIdKey(d))
+	c.Check(m.MongoIdKey(42.0), Equals, m.MongoIdKey(int64(42)))
+	c.Check(m.MongoIdKey("42"), Not(Equals), m.MongoIdKey(42))
+}
+
+func (s *MySuite) TestFormatMongoId(c *C) {
+	hex := "58e52d2d6c5bd6a8f1c8a7a1"
+	c.Check(m.FormatMongoId(bson.ObjectIdHex(hex)), Equals, hex)
+	c.Check(m.FormatMongoId("abc"), Equals, "abc")
+	c.Check(m.FormatMongoId(42), Equals, "42")
+	c.Check(m.FormatMongoId(float64(42)), Equals, "42")
+	c.Check(m.FormatMongoId(4.5), Equals, "4.5")
+	uuid := []byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	c.Check(m.FormatMongoId(bson.Binary{Kind: 0x04, Data: uuid}), Equals, "6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	d, _ := bson.ParseDecimal128("4.50")
+	c.Check(m.FormatMongoId(d), Equals, "4.50")
+	c.Check(m.FormatMongoId(time.Date(2017, 4, 5, 23, 30, 0, 0, time.UTC)), Equals, "2017-04-05T23:30:00Z")
+	c.Check(m.FormatMongoId(bson.D{{Name: "b", Value: 1}, {Name: "a", Value: "x"}}), Equals, `{"a":"x","b":1}`)
+}
+
+func (s *MySuite) TestBuildSelectIds(c *C) {
+	collection := m.Collection{Name: "users", PgTable: "users", Fields: BuildFields("_id")}
+	o := m.Statement{collection}
+	c.Check(o.BuildSelectIds(false), Equals, `SELECT "_id"::text FROM "users" ORDER BY "_id" LIMIT $1;`)
+	c.Check(o.BuildSelectIds(true), Equals, `SELECT "_id"::text FROM "users" WHERE "_id" > $1 ORDER BY "_id" LIMIT $2;`)
+}
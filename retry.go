@@ -0,0 +1,75 @@
+package moresql
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+)
+
+// defaultRetryBackoff is the delay before the first retry,
+// doubled on each subsequent attempt
+const defaultRetryBackoff = time.Duration(100) * time.Millisecond
+
+// transientErrorClasses are Postgres SQLSTATE classes where repeating
+// the same statement may succeed
+var transientErrorClasses = map[pq.ErrorClass]bool{
+	"08": true, // connection_exception
+	"40": true, // transaction_rollback, ie serialization_failure or deadlock_detected
+	"53": true, // insufficient_resources
+	"57": true, // operator_intervention, ie admin_shutdown
+}
+
+// IsTransientError reports whether err is worth retrying. Everything
+// else, ie constraint violations or type mismatches, will fail again
+// until the schema or data changes.
+func IsTransientError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *pq.Error:
+		return transientErrorClasses[e.Code.Class()]
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Backoff retries transient errors with exponential backoff
+type Backoff struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+	Sleep    func(time.Duration)
+}
+
+// NewBackoff builds a Backoff allowing attempts tries in total
+func NewBackoff(attempts int, max time.Duration) Backoff {
+	return Backoff{Attempts: attempts, Initial: defaultRetryBackoff, Max: max, Sleep: time.Sleep}
+}
+
+// Retry calls fn until it succeeds, returns a permanent error or
+// attempts are exhausted. Returns the last error from fn.
+func (b Backoff) Retry(fn func() error) error {
+	delay := b.Initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !IsTransientError(err) || attempt >= b.Attempts {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+			"error":   err,
+		}).Warn("Retrying after transient error")
+		b.Sleep(delay)
+		delay *= 2
+		if delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
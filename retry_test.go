@@ -0,0 +1,67 @@
+package moresql_test
+
+import (
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestIsTransientError(c *C) {
+	var table = []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "22P02"}, false},
+		{&pq.Error{Code: "42703"}, false},
+		{errors.New("something else"), false},
+	}
+	for _, t := range table {
+		c.Check(m.IsTransientError(t.err), Equals, t.transient)
+	}
+}
+
+func (s *MySuite) TestBackoffRetry(c *C) {
+	var delays []time.Duration
+	b := m.Backoff{Attempts: 4, Initial: 100 * time.Millisecond, Max: 250 * time.Millisecond, Sleep: func(d time.Duration) { delays = append(delays, d) }}
+
+	calls := 0
+	err := b.Retry(func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	c.Check(err, Equals, driver.ErrBadConn)
+	c.Check(calls, Equals, 4)
+	c.Check(delays, DeepEquals, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond})
+
+	// Permanent errors are not retried
+	calls = 0
+	permanent := &pq.Error{Code: "23505"}
+	err = b.Retry(func() error {
+		calls++
+		return permanent
+	})
+	c.Check(err, Equals, permanent)
+	c.Check(calls, Equals, 1)
+
+	// Success after a transient error
+	calls = 0
+	err = b.Retry(func() error {
+		calls++
+		if calls < 2 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	c.Check(err, Equals, nil)
+	c.Check(calls, Equals, 2)
+}
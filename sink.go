@@ -0,0 +1,194 @@
+package moresql
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+)
+
+// Sink is the destination for operations read from Mongo.
+// Tailer and FullSyncer depend only on this interface so that
+// destinations other than Postgres can be added without altering
+// the read side of either mode.
+type Sink interface {
+	// Upsert writes data for collection, inserting or replacing the row
+	// identified by data["_id"]
+	Upsert(c Collection, data map[string]interface{}) error
+	// Delete removes the row identified by data["_id"] and its child rows
+	Delete(c Collection, data map[string]interface{}) error
+	// Write applies every operation in batch, and its checkpoint if any, atomically
+	Write(b Batch) error
+	// Checkpoint persists the position of the most recently applied operation
+	Checkpoint(m MoresqlMetadata) error
+	// DeadLetter records an operation which could not be applied
+	DeadLetter(d DeadLetter) error
+	// Close releases resources held by the sink
+	Close() error
+}
+
+// SinkOp is a single sanitized write destined for a Sink
+type SinkOp struct {
+	Collection Collection
+	Delete     bool
+	Data       map[string]interface{}
+	// Children holds the rows of each of Collection.Children, in the same
+	// order, which replace the existing child rows of an upsert
+	Children [][]map[string]interface{}
+}
+
+// NewSinkOp sanitizes op into a write for c
+func NewSinkOp(c Collection, op *gtm.Op) SinkOp {
+	return SinkOp{Collection: c, Delete: op.IsDelete(), Data: sanitizeCollection(c, op), Children: SanitizeChildren(c, op)}
+}
+
+// Batch groups writes which are applied together. Callers are expected
+// to collapse multiple operations on the same _id before building a Batch.
+// When Checkpoint is set it is persisted atomically with Ops.
+type Batch struct {
+	Ops        []SinkOp
+	Checkpoint *MoresqlMetadata
+}
+
+// PostgresSink is the default Sink which applies operations
+// to Postgres using the SQL generated by Statement
+type PostgresSink struct {
+	pg *sqlx.DB
+	q  Queries
+}
+
+// NewPostgresSink wraps an existing Postgres connection pool. Checkpoints
+// and dead letters are written to tables in metadataSchema.
+func NewPostgresSink(pg *sqlx.DB, metadataSchema string) *PostgresSink {
+	return &PostgresSink{pg: pg, q: Queries{Schema: metadataSchema}}
+}
+
+func (p *PostgresSink) Upsert(c Collection, data map[string]interface{}) error {
+	defer metrics.SQL("upsert", time.Now())
+	o := Statement{c}
+	_, err := p.pg.NamedExec(o.BuildUpsert(), data)
+	return err
+}
+
+func (p *PostgresSink) Delete(c Collection, data map[string]interface{}) error {
+	if len(c.Children) > 0 {
+		// Child rows are removed in the same transaction
+		return p.Write(Batch{Ops: []SinkOp{{Collection: c, Delete: true, Data: data}}})
+	}
+	defer metrics.SQL("delete", time.Now())
+	o := Statement{c}
+	_, err := p.pg.NamedExec(o.BuildDelete(), data)
+	return err
+}
+
+// Write applies the batch inside a single transaction using one multi row
+// upsert and one multi row delete per table, followed by the checkpoint.
+// Child rows of every op are deleted and those of upserts inserted again.
+func (p *PostgresSink) Write(b Batch) error {
+	defer metrics.SQL("batch", time.Now())
+	tx, err := p.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, g := range groupByTable(b.Ops) {
+		if err = writeTable(tx, g); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if b.Checkpoint != nil {
+		if _, err = tx.NamedExec(p.q.SaveMetadata(), *b.Checkpoint); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func writeTable(tx *sqlx.Tx, g *tableOps) error {
+	o := Statement{g.collection}
+	parents := append(append([]map[string]interface{}{}, g.upserts...), g.deletes...)
+	for _, child := range g.collection.Children {
+		c := Statement{child.table(g.collection)}
+		deleteChildren := func(rows int) string { return c.BuildBatchDeleteBy(child.parentColumn(), rows) }
+		if err := execChunked(tx, parents, maxBindParameters, deleteChildren, o.BatchDeleteArgs); err != nil {
+			return err
+		}
+	}
+	if err := execChunked(tx, g.upserts, o.BatchRowLimit(), o.BuildBatchUpsert, o.BatchUpsertArgs); err != nil {
+		return err
+	}
+	if err := execChunked(tx, g.deletes, maxBindParameters, o.BuildBatchDelete, o.BatchDeleteArgs); err != nil {
+		return err
+	}
+	for i, child := range g.collection.Children {
+		c := Statement{child.table(g.collection)}
+		if err := execChunked(tx, g.children[i], c.BatchRowLimit(), c.BuildBatchInsert, c.BatchUpsertArgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tableOps struct {
+	collection Collection
+	upserts    []map[string]interface{}
+	deletes    []map[string]interface{}
+	// children holds the rows of each of collection.Children for upserts
+	children [][]map[string]interface{}
+}
+
+// groupByTable splits ops by destination table, keeping tables in
+// the order they first appear
+func groupByTable(ops []SinkOp) []*tableOps {
+	var groups []*tableOps
+	byTable := make(map[string]*tableOps)
+	for _, op := range ops {
+		table := op.Collection.pgTableQuoted()
+		g, ok := byTable[table]
+		if !ok {
+			g = &tableOps{collection: op.Collection, children: make([][]map[string]interface{}, len(op.Collection.Children))}
+			byTable[table] = g
+			groups = append(groups, g)
+		}
+		if op.Delete {
+			g.deletes = append(g.deletes, op.Data)
+		} else {
+			g.upserts = append(g.upserts, op.Data)
+			for i, rows := range op.Children {
+				g.children[i] = append(g.children[i], rows...)
+			}
+		}
+	}
+	return groups
+}
+
+func execChunked(tx *sqlx.Tx, rows []map[string]interface{}, limit int, build func(int) string, args func([]map[string]interface{}) []interface{}) error {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > limit {
+			n = limit
+		}
+		if _, err := tx.Exec(build(n), args(rows[:n])...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+func (p *PostgresSink) Checkpoint(m MoresqlMetadata) error {
+	defer metrics.SQL("checkpoint", time.Now())
+	_, err := p.pg.NamedExec(p.q.SaveMetadata(), m)
+	return err
+}
+
+func (p *PostgresSink) DeadLetter(d DeadLetter) error {
+	_, err := p.pg.NamedExec(p.q.SaveDeadLetter(), d)
+	return err
+}
+
+// Close is a noop as the connection pool is owned by the caller
+func (p *PostgresSink) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+// fakeSink records the calls made to it, failing each with its error
+type fakeSink struct {
+	calls         []string
+	err           error
+	deadLetterErr error
+	deadLetters   []m.DeadLetter
+}
+
+func (f *fakeSink) Upsert(c m.Collection, data map[string]interface{}) error {
+	f.calls = append(f.calls, "upsert "+c.Name)
+	return f.err
+}
+
+func (f *fakeSink) Delete(c m.Collection, data map[string]interface{}) error {
+	f.calls = append(f.calls, "delete "+c.Name)
+	return f.err
+}
+
+func (f *fakeSink) Write(b m.Batch) error {
+	f.calls = append(f.calls, "write")
+	return f.err
+}
+
+func (f *fakeSink) Checkpoint(md m.MoresqlMetadata) error {
+	f.calls = append(f.calls, "checkpoint")
+	return f.err
+}
+
+func (f *fakeSink) DeadLetter(d m.DeadLetter) error {
+	f.calls = append(f.calls, "dead letter")
+	if f.deadLetterErr != nil {
+		return f.deadLetterErr
+	}
+	f.deadLetters = append(f.deadLetters, d)
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+func (s *MySuite) TestWritesRouteThroughSink(c *C) {
+	users := m.Collection{Name: "users"}
+	parents := m.Collection{Name: "parents", Children: []m.Child{{Path: "books"}}}
+	var table = []struct {
+		op       m.SinkOp
+		expected []string
+	}{
+		{m.SinkOp{Collection: users, Data: map[string]interface{}{"_id": "a"}}, []string{"upsert users"}},
+		{m.SinkOp{Collection: users, Delete: true, Data: map[string]interface{}{"_id": "a"}}, []string{"delete users"}},
+		// Child rows are replaced atomically with their parent
+		{m.SinkOp{Collection: parents, Data: map[string]interface{}{"_id": "a"}}, []string{"write"}},
+		{m.SinkOp{Collection: parents, Delete: true, Data: map[string]interface{}{"_id": "a"}}, []string{"write"}},
+	}
+	for _, t := range table {
+		sink := &fakeSink{}
+		op := &gtm.Op{Id: "a", Operation: "i", Namespace: "app." + t.op.Collection.Name}
+		c.Check(m.WriteOrDeadLetter(sink, noSleepBackoff(1), "app", op, t.op), IsNil)
+		c.Check(sink.calls, DeepEquals, t.expected)
+	}
+}
+
+func (s *MySuite) TestPostgresSinkIsBulkLoader(c *C) {
+	var sink m.Sink = m.NewPostgresSink(nil, "public")
+	_, ok := sink.(m.BulkLoader)
+	c.Check(ok, Equals, true)
+}
+
+func (s *MySuite) TestCollapseRowsKeepsLastPerId(c *C) {
+	coll := m.Collection{Name: "users", Fields: m.Fields{"_id": m.Field{m.Mongo{"_id", "id"}, m.Postgres{"id", "text"}}}}
+	rows := []map[string]interface{}{
+		{"id": "a", "name": "first"},
+		{"id": "b", "name": "only"},
+		{"id": "a", "name": "second"},
+	}
+	c.Check(m.CollapseRows(coll, rows), DeepEquals, []map[string]interface{}{
+		{"id": "a", "name": "second"},
+		{"id": "b", "name": "only"},
+	})
+}
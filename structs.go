@@ -5,17 +5,27 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type DBResult struct {
 	MongoDB    string
 	Collection string
 	Data       map[string]interface{}
+	// done is called once the document has been written
+	done func()
+}
+
+func (e DBResult) markWritten() {
+	if e.done != nil {
+		e.done()
+	}
 }
 
 type MongoResult struct {
@@ -32,25 +42,54 @@ type urls struct {
 }
 
 type Env struct {
-	urls                  urls
-	sync                  bool
-	tail                  bool
-	SSLCert               string
-	SSLInsecureSkipVerify bool
-	configFile            string
-	allowDeletes          bool
-	monitor               bool
-	replayOplog           bool
-	replayDuration        time.Duration
-	replaySecond          int64
-	checkpoint            bool
-	appName               string
-	createTableSQL        bool
-	validatePostgres      bool
-	reportingToken        string
-	appEnvironment        string
-	errorReporting        string
-	memprofile            string
+	urls                   urls
+	sync                   bool
+	tail                   bool
+	SSLCert                string
+	SSLInsecureSkipVerify  bool
+	configFile             string
+	allowDeletes           bool
+	monitor                bool
+	monitorAddr            string
+	healthMaxLag           time.Duration
+	healthMaxIdle          time.Duration
+	healthMaxCheckpointAge time.Duration
+	adminToken             string
+	replayOplog            bool
+	replayDuration         time.Duration
+	replaySecond           string
+	replayTimestamp        bson.MongoTimestamp
+	checkpoint             bool
+	appName                string
+	createTableSQL         bool
+	validatePostgres       bool
+	reportingToken         string
+	appEnvironment         string
+	errorReporting         string
+	memprofile             string
+	source                 string
+	batchSize              int
+	batchDuration          time.Duration
+	retryAttempts          int
+	retryMaxBackoff        time.Duration
+	replayDeadLetters      bool
+	shutdownTimeout        time.Duration
+	migrate                bool
+	migrateDryRun          bool
+	metadataSchema         string
+	fullSyncCollections    string
+	fullSyncFilter         string
+	fullSyncStatus         bool
+	fullSyncReaders        int
+	fullSyncPartitions     int
+	bulkCopy               bool
+	bootstrap              bool
+	verify                 bool
+	verifyFix              bool
+
+	// fullSyncRestart is set by -bootstrap when previous progress
+	// does not match the oplog position it tails from
+	fullSyncRestart bool
 }
 
 func (e *Env) UseSSL() (r bool) {
@@ -61,51 +100,209 @@ func (e *Env) UseSSL() (r bool) {
 	return
 }
 
-// Queries contains the sql commands used by Moresql
-type Queries struct{}
+// Queries holds the SQL used by moresql. Schema is where moresql_metadata
+// and moresql_dead_letters live, public when empty.
+type Queries struct {
+	Schema string
+}
+
+func (q *Queries) schema() string {
+	if q.Schema == "" {
+		return defaultSchema
+	}
+	return q.Schema
+}
+
+func (q *Queries) metadataTable() string {
+	return fmt.Sprintf(`"%s"."moresql_metadata"`, q.schema())
+}
+
+func (q *Queries) syncProgressTable() string {
+	return fmt.Sprintf(`"%s"."moresql_sync_progress"`, q.schema())
+}
+
+func (q *Queries) deadLettersTable() string {
+	return fmt.Sprintf(`"%s"."moresql_dead_letters"`, q.schema())
+}
 
 // GetMetadata fetches the most recent metadata row for this appname
 func (q *Queries) GetMetadata() string {
-	return `SELECT * FROM moresql_metadata WHERE app_name=$1 ORDER BY last_epoch DESC LIMIT 1;`
+	return fmt.Sprintf(`SELECT * FROM %s WHERE app_name=$1 ORDER BY last_timestamp DESC NULLS LAST, last_epoch DESC LIMIT 1;`, q.metadataTable())
 }
 
 // SaveMetadata performs an upsert using metadata with uniqueness constraint on app_name
 func (q *Queries) SaveMetadata() string {
-	return `INSERT INTO "moresql_metadata" ("app_name", "last_epoch", "processed_at")
-VALUES (:app_name, :last_epoch, :processed_at)
+	return fmt.Sprintf(`INSERT INTO %s ("app_name", "last_epoch", "last_timestamp", "resume_token", "processed_at")
+VALUES (:app_name, :last_epoch, :last_timestamp, :resume_token, :processed_at)
 ON CONFLICT ("app_name")
-DO UPDATE SET "last_epoch" = :last_epoch, "processed_at" = :processed_at;`
+DO UPDATE SET "last_epoch" = :last_epoch, "last_timestamp" = :last_timestamp, "resume_token" = :resume_token, "processed_at" = :processed_at;`, q.metadataTable())
+}
+
+// MigrateMetadataTable brings a metadata table created by an earlier release
+// up to date. Safe to run repeatedly.
+func (q *Queries) MigrateMetadataTable() string {
+	return fmt.Sprintf(`
+DO $$
+BEGIN
+  ALTER TABLE %[1]s ADD COLUMN resume_token TEXT NULL;
+EXCEPTION
+  WHEN duplicate_column THEN NULL;
+END $$;
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM information_schema.columns
+             WHERE table_schema = '%[2]s' AND table_name = 'moresql_metadata' AND column_name = 'last_epoch' AND data_type = 'integer') THEN
+    ALTER TABLE %[1]s ALTER COLUMN last_epoch TYPE BIGINT;
+  END IF;
+END $$;
+DO $$
+BEGIN
+  ALTER TABLE %[1]s ADD COLUMN last_timestamp BIGINT NULL;
+  -- Existing checkpoints only know the second, start from its first op
+  UPDATE %[1]s SET last_timestamp = last_epoch << 32;
+EXCEPTION
+  WHEN duplicate_column THEN NULL;
+END $$;`, q.metadataTable(), q.schema())
 }
 
 // CreateMetadataTable provides the sql required to setup the metadata table
 func (q *Queries) CreateMetadataTable() string {
-	return `
+	return fmt.Sprintf(`
 -- create the moresql_metadata table for checkpoint persistance
-CREATE TABLE public.moresql_metadata
+CREATE TABLE %[1]s
 (
     app_name TEXT NOT NULL,
-    last_epoch INT NOT NULL,
+    last_epoch BIGINT NOT NULL,
+    last_timestamp BIGINT NULL,
+    resume_token TEXT NULL,
     processed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
 );
 -- Setup mandatory unique index
-CREATE UNIQUE INDEX moresql_metadata_app_name_uindex ON public.moresql_metadata (app_name);
+CREATE UNIQUE INDEX moresql_metadata_app_name_uindex ON %[1]s (app_name);
 
 -- Grant permissions to this user, replace $USERNAME with moresql's user
-GRANT SELECT, UPDATE, DELETE ON TABLE public.moresql_metadata TO $USERNAME;
+GRANT SELECT, UPDATE, DELETE ON TABLE %[1]s TO $USERNAME;
+
+COMMENT ON COLUMN %[1]s.app_name IS 'Name of application. Used for circumstances where multiple apps stream to same PG instance.';
+COMMENT ON COLUMN %[1]s.last_epoch IS 'Most recent epoch processed from Mongo';
+COMMENT ON COLUMN %[1]s.last_timestamp IS 'Most recent oplog timestamp processed from Mongo, seconds and increment as a bson.MongoTimestamp';
+COMMENT ON COLUMN %[1]s.resume_token IS 'Change stream resume token, used instead of last_epoch when -source=changestream';
+COMMENT ON COLUMN %[1]s.processed_at IS 'Timestamp for when the last epoch was processed at';
+COMMENT ON TABLE %[1]s IS 'Stores checkpoint data for MoreSQL (mongo->pg) streaming';
+`, q.metadataTable())
+}
+
+// CreateDeadLettersTable provides the sql for the table holding ops that failed to apply
+func (q *Queries) CreateDeadLettersTable() string {
+	return fmt.Sprintf(`
+-- create the moresql_dead_letters table for ops that could not be applied
+CREATE TABLE IF NOT EXISTS %[1]s
+(
+    id BIGSERIAL PRIMARY KEY,
+    app_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    op_id TEXT NOT NULL,
+    document JSONB NOT NULL,
+    op_timestamp BIGINT NOT NULL,
+    error TEXT NOT NULL,
+    attempts INT DEFAULT 1 NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+CREATE INDEX IF NOT EXISTS moresql_dead_letters_app_name_index ON %[1]s (app_name, id);
+
+COMMENT ON COLUMN %[1]s.namespace IS 'Mongo db.collection the op was read from';
+COMMENT ON COLUMN %[1]s.document IS 'Unsanitized _id and op data as Mongo extended JSON';
+COMMENT ON COLUMN %[1]s.error IS 'Most recent error returned while applying the op';
+COMMENT ON TABLE %[1]s IS 'Ops MoreSQL was unable to apply, replay with -replay-dead-letters';
+`, q.deadLettersTable())
+}
+
+// SaveDeadLetter inserts a failed op
+func (q *Queries) SaveDeadLetter() string {
+	return fmt.Sprintf(`INSERT INTO %s ("app_name", "namespace", "operation", "op_id", "document", "op_timestamp", "error", "attempts", "created_at")
+VALUES (:app_name, :namespace, :operation, :op_id, :document, :op_timestamp, :error, :attempts, :created_at);`, q.deadLettersTable())
+}
+
+// GetDeadLetters pages through dead letters for an app_name in insertion order
+func (q *Queries) GetDeadLetters() string {
+	return fmt.Sprintf(`SELECT * FROM %s WHERE app_name=$1 AND id > $2 ORDER BY id LIMIT $3;`, q.deadLettersTable())
+}
+
+// UpdateDeadLetter records another failed replay attempt
+func (q *Queries) UpdateDeadLetter() string {
+	return fmt.Sprintf(`UPDATE %s SET "error" = :error, "attempts" = "attempts" + 1 WHERE "id" = :id;`, q.deadLettersTable())
+}
+
+// DeleteDeadLetter removes a dead letter once replayed
+func (q *Queries) DeleteDeadLetter() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE id=$1;`, q.deadLettersTable())
+}
+
+// CreateSyncProgressTable provides the sql for the table tracking full sync progress
+func (q *Queries) CreateSyncProgressTable() string {
+	return fmt.Sprintf(`
+-- create the moresql_sync_progress table for resuming full sync
+CREATE TABLE IF NOT EXISTS %[1]s
+(
+    app_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    range_index INT DEFAULT 0 NOT NULL,
+    range_min TEXT NULL,
+    range_max TEXT NULL,
+    last_id TEXT NULL,
+    synced BIGINT DEFAULT 0 NOT NULL,
+    total BIGINT DEFAULT 0 NOT NULL,
+    completed_at TIMESTAMP WITH TIME ZONE NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+    PRIMARY KEY (app_name, namespace, range_index)
+);
+
+COMMENT ON COLUMN %[1]s.namespace IS 'Mongo db.collection being synced';
+COMMENT ON COLUMN %[1]s.range_index IS 'Position of this _id range within the collection';
+COMMENT ON COLUMN %[1]s.range_min IS 'Inclusive lower _id bound as Mongo extended JSON, NULL for the first range';
+COMMENT ON COLUMN %[1]s.range_max IS 'Exclusive upper _id bound as Mongo extended JSON, NULL for the last range';
+COMMENT ON COLUMN %[1]s.last_id IS 'Highest _id synced within the range, as Mongo extended JSON. Full sync resumes after it';
+COMMENT ON COLUMN %[1]s.total IS 'Estimated documents in the collection when its sync started';
+COMMENT ON TABLE %[1]s IS 'Tracks progress of -full-sync so that it can resume after a restart';
+`, q.syncProgressTable())
+}
+
+// GetSyncProgress fetches the full sync progress of each collection for an app_name
+func (q *Queries) GetSyncProgress() string {
+	return fmt.Sprintf(`SELECT * FROM %s WHERE app_name=$1 ORDER BY namespace, range_index;`, q.syncProgressTable())
+}
 
-COMMENT ON COLUMN public.moresql_metadata.app_name IS 'Name of application. Used for circumstances where multiple apps stream to same PG instance.';
-COMMENT ON COLUMN public.moresql_metadata.last_epoch IS 'Most recent epoch processed from Mongo';
-COMMENT ON COLUMN public.moresql_metadata.processed_at IS 'Timestamp for when the last epoch was processed at';
-COMMENT ON TABLE public.moresql_metadata IS 'Stores checkpoint data for MoreSQL (mongo->pg) streaming';
-`
+// SaveSyncProgress upserts the progress of a single _id range
+func (q *Queries) SaveSyncProgress() string {
+	return fmt.Sprintf(`INSERT INTO %s ("app_name", "namespace", "range_index", "range_min", "range_max", "last_id", "synced", "total", "completed_at", "updated_at")
+VALUES (:app_name, :namespace, :range_index, :range_min, :range_max, :last_id, :synced, :total, :completed_at, :updated_at)
+ON CONFLICT ("app_name", "namespace", "range_index")
+DO UPDATE SET "last_id" = :last_id, "synced" = :synced, "total" = :total, "completed_at" = :completed_at, "updated_at" = :updated_at;`, q.syncProgressTable())
+}
+
+// ResetSyncProgress removes the progress of an app_name's namespaces in $2,
+// a text array literal built by PostgresTextArray, so that their next full sync starts over
+func (q *Queries) ResetSyncProgress() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE app_name=$1 AND namespace = ANY($2::text[]);`, q.syncProgressTable())
+}
+
+// SchemaExists counts the schemas named $1
+func (q *Queries) SchemaExists() string {
+	return `SELECT count(*) FROM pg_catalog.pg_namespace WHERE nspname = $1;`
 }
 
 func (q *Queries) GetColumnsFromTable() string {
 	return `
-SELECT column_name
-FROM information_schema.columns
-WHERE table_schema = :schema
-  AND table_name   = :table`
+SELECT a.attname AS column_name,
+       format_type(a.atttypid, a.atttypmod) AS column_type
+FROM pg_catalog.pg_attribute a
+JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = :schema
+  AND c.relname = :table
+  AND a.attnum > 0
+  AND NOT a.attisdropped`
 }
 
 func (q *Queries) GetTableColumnIndexMetadata() string {
@@ -151,7 +348,7 @@ WITH tables_and_indexes AS (
       LEFT JOIN pg_class AS i ON ix.indexrelid = i.oid
 
     WHERE c.relkind = 'r' :: CHAR
-          AND n.nspname = 'public'  -- Replace with Schema name
+          AND n.nspname = $3
           --AND c.relname = 'nodes'  -- Replace with table name, or Comment this for get all tables
           AND f.attnum > 0
     ORDER BY c.relname, f.attname
@@ -167,15 +364,18 @@ AND is_index IS TRUE
 
 type Commands struct{}
 
-func (c *Commands) CreateTableSQL() {
-	q := Queries{}
+func (c *Commands) CreateTableSQL(schema string) {
+	q := Queries{Schema: schema}
 	fmt.Print("-- Execute the following SQL to setup table in Postgres. Replace $USERNAME with the moresql user.")
 	fmt.Println(q.CreateMetadataTable())
+	fmt.Println(q.CreateDeadLettersTable())
+	fmt.Println(q.CreateSyncProgressTable())
 	os.Exit(0)
 }
 
 type ColumnResult struct {
 	Name string `db:"column_name"`
+	Type string `db:"column_type"`
 }
 
 type TableColumn struct {
@@ -187,12 +387,32 @@ type TableColumn struct {
 	Solution string
 }
 
+func (t *TableColumn) qualifiedTable() string {
+	return fmt.Sprintf(`"%s"."%s"`, t.Schema, t.Table)
+}
+
 func (t *TableColumn) uniqueIndex() string {
-	return fmt.Sprintf("CREATE UNIQUE INDEX %s_service_uindex_on_%s ON %s.%s (%s);", t.Table, t.Column, t.Schema, t.Table, t.Column)
+	return fmt.Sprintf(`CREATE UNIQUE INDEX "%s_service_uindex_on_%s" ON %s ("%s");`, t.Table, t.Column, t.qualifiedTable(), t.Column)
+}
+
+func (t *TableColumn) index() string {
+	return fmt.Sprintf(`CREATE INDEX "%s_index_on_%s" ON %s ("%s");`, t.Table, t.Column, t.qualifiedTable(), t.Column)
 }
 
 func (t *TableColumn) createColumn() string {
-	return fmt.Sprintf(`ALTER TABLE %s.%s ADD %s %s NULL;`, t.Schema, t.Table, normalizeDotNotationToPostgresNaming(t.Column), t.Type)
+	return fmt.Sprintf(`ALTER TABLE %s ADD "%s" %s NULL;`, t.qualifiedTable(), normalizeDotNotationToPostgresNaming(t.Column), t.Type)
+}
+
+func (t *TableColumn) alterColumnType() string {
+	return fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN "%s" TYPE %s USING "%s"::%s;`, t.qualifiedTable(), t.Column, t.Type, t.Column, t.Type)
+}
+
+func (t *TableColumn) createSchema() string {
+	return fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s";`, t.Schema)
+}
+
+func (t *TableColumn) createTable() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s();`, t.qualifiedTable())
 }
 
 type hasUniqueIndex struct {
@@ -206,79 +426,132 @@ func (h *hasUniqueIndex) isValid() bool {
 	return false
 }
 
-func (c *Commands) ValidateTablesAndColumns(config Config, pg *sqlx.DB) {
-	q := Queries{}
-	missingColumns := []TableColumn{}
+// PlanMigration compares the tables and columns Postgres has against
+// the configuration and returns the changes required to reconcile them
+func (c *Commands) PlanMigration(config Config, pg *sqlx.DB) (MigrationPlan, error) {
+	plan := MigrationPlan{}
 	// Validates configuration of Postgres based on config file
 	// Only validates SELECT and column existance
-	for _, db := range config {
-		for _, coll := range db.Collections {
-			table := coll.PgTable
-			// TODO: allow for non-public schema
-			schema := "public"
-			// Check that all columns are present
-			rows, err := pg.NamedQuery(q.GetColumnsFromTable(), map[string]interface{}{"schema": schema, "table": table})
-			if err != nil {
-				log.Error(err)
+	for _, dbName := range sortedDBNames(config) {
+		db := config[dbName]
+		for _, collName := range sortedCollectionNames(db) {
+			coll := db.Collections[collName]
+			o := Statement{coll}
+			// Check that each table has _id as in a unique index
+			if err := c.planTable(pg, &plan, coll, o.id().Postgres.Name, true); err != nil {
+				return plan, err
 			}
-			// TODO: add validation that column types equal the types present in config
-
-			resultMap := make(map[string]string)
-			for rows.Next() {
-				var row ColumnResult
-				err := rows.StructScan(&row)
-				if err != nil {
-					log.Fatalln(err)
+			// Child rows are found by their parent's _id
+			for _, child := range coll.Children {
+				if err := c.planTable(pg, &plan, child.table(coll), child.ParentKey, false); err != nil {
+					return plan, err
 				}
-				resultMap[row.Name] = row.Name
 			}
+		}
+	}
+	return plan, nil
+}
 
-			for _, field := range coll.Fields {
-				k := field.Postgres.Name
-				_, ok := resultMap[k]
-				if ok != true {
-					t := TableColumn{Schema: schema, Table: table, Column: k, Message: "Missing Column", Type: field.Postgres.Type}
-					t.Solution = t.createColumn()
-					missingColumns = append(missingColumns, t)
-				}
-			}
+// planTable adds the changes required for coll's table and an index
+// on the indexed column to plan
+func (c *Commands) planTable(pg *sqlx.DB, plan *MigrationPlan, coll Collection, indexed string, unique bool) error {
+	q := Queries{}
+	table := coll.PgTable
+	schema := coll.pgSchema()
+	// Check that all columns are present
+	rows, err := pg.NamedQuery(q.GetColumnsFromTable(), map[string]interface{}{"schema": schema, "table": table})
+	if err != nil {
+		return err
+	}
 
-			// Check that each table has _id as in a unique index
-			r := hasUniqueIndex{}
-			err = pg.Get(&r, q.GetTableColumnIndexMetadata(), table, "_id")
-			if err != nil {
-				log.Error(err)
-			}
+	resultMap := make(map[string]string)
+	for rows.Next() {
+		var row ColumnResult
+		err := rows.StructScan(&row)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		resultMap[row.Name] = row.Type
+	}
+	rows.Close()
 
-			if r.isValid() == false {
-				t := TableColumn{Schema: schema, Table: table, Column: "_id", Message: "Missing Unique Index on Column", Type: ""}
-				t.Solution = t.uniqueIndex()
-				missingColumns = append(missingColumns, t)
+	if len(resultMap) == 0 {
+		if !plan.hasSchema(schema) {
+			var count int
+			if err := pg.Get(&count, q.SchemaExists(), schema); err != nil {
+				return err
+			}
+			if count == 0 {
+				plan.Schemas = append(plan.Schemas, TableColumn{Schema: schema, Message: "Missing Schema"})
 			}
-
 		}
+		plan.Tables = append(plan.Tables, TableColumn{Schema: schema, Table: table, Message: "Missing Table"})
 	}
-	if len(missingColumns) != 0 {
-		log.Print("The following errors were reported:")
-		tables := make(map[string]TableColumn)
-		for _, v := range missingColumns {
-			log.Printf("Table %s.%s Column: %s, Error: %s", v.Schema, v.Table, v.Column, v.Message)
-			tables[v.Table] = v
+
+	o := Statement{coll}
+	for _, k := range o.sortedKeys() {
+		field := coll.Fields[k]
+		actual, ok := resultMap[field.Postgres.Name]
+		if ok != true {
+			t := TableColumn{Schema: schema, Table: table, Column: field.Postgres.Name, Message: "Missing Column", Type: field.Postgres.Type}
+			t.Solution = t.createColumn()
+			plan.Columns = append(plan.Columns, t)
+		} else if !PostgresTypesEqual(field.Postgres.Type, actual) {
+			msg := fmt.Sprintf("Column Type Mismatch, configured %s but found %s", field.Postgres.Type, actual)
+			t := TableColumn{Schema: schema, Table: table, Column: field.Postgres.Name, Message: msg, Type: field.Postgres.Type}
+			t.Solution = t.alterColumnType()
+			plan.Types = append(plan.Types, t)
 		}
-		log.Printf("SQL Output to assist with correcting table schema malformation:")
+	}
 
-		// Table level advice
-		// CREATE TABLE IF NOT EXISTS public.distributions();
-		for _, v := range tables {
-			fmt.Printf("CREATE TABLE IF NOT EXISTS %s.%s();\n", v.Schema, v.Table)
+	r := hasUniqueIndex{}
+	err = pg.Get(&r, q.GetTableColumnIndexMetadata(), table, indexed, schema)
+	if err != nil {
+		return err
+	}
+
+	if r.isValid() == false {
+		t := TableColumn{Schema: schema, Table: table, Column: indexed, Type: ""}
+		if unique {
+			t.Message = "Missing Unique Index on Column"
+			t.Solution = t.uniqueIndex()
+		} else {
+			t.Message = "Missing Index on Column"
+			t.Solution = t.index()
 		}
+		plan.Indexes = append(plan.Indexes, t)
+	}
+	return nil
+}
 
-		// Column level advice
-		for _, v := range missingColumns {
-			fmt.Printf("%s\n", v.Solution)
+func (c *Commands) ValidateTablesAndColumns(config Config, pg *sqlx.DB) {
+	exprErr := CompileExpressions(config)
+	if exprErr != nil {
+		log.Print(exprErr)
+	}
+	plan, err := c.PlanMigration(config, pg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !plan.Empty() {
+		log.Print("The following errors were reported:")
+		plan.Report()
+		log.Printf("SQL Output to assist with correcting table schema malformation (apply with -migrate):")
+		for _, s := range plan.Statements() {
+			fmt.Println(s)
+		}
+		if len(plan.Types) > 0 {
+			log.Printf("SQL Output to assist with correcting column types (review before applying, not applied by -migrate):")
+			for _, t := range plan.Types {
+				fmt.Println(t.Solution)
+			}
 		}
 		os.Exit(1)
 	}
+	if exprErr != nil {
+		os.Exit(1)
+	}
 	log.Printf("Validation succeeded. Postgres tables look good.")
 	os.Exit(0)
 }
@@ -308,25 +581,76 @@ type FieldShorthand map[string]string
 type FieldsWrapper map[string]json.RawMessage
 
 type Collection struct {
-	Name    string `json:"name"`
-	PgTable string `json:"pg_table"`
-	Fields  Fields `json:"fields"`
+	Name      string `json:"name"`
+	PgTable   string `json:"pg_table"`
+	PgSchema  string `json:"pg_schema"`
+	Reconcile string `json:"reconcile"`
+	Fields    Fields `json:"fields"`
+	// Children are sorted by Path
+	Children []Child `json:"children"`
+	// ExtraProps names the JSONB column receiving unmapped keys, it is
+	// also present in Fields
+	ExtraProps string `json:"extra_props"`
 }
 
 type CollectionDelayed struct {
-	Name    string          `json:"name"`
-	PgTable string          `json:"pg_table"`
-	Fields  json.RawMessage `json:"fields"`
+	Name       string          `json:"name"`
+	PgTable    string          `json:"pg_table"`
+	PgSchema   string          `json:"pg_schema"`
+	Reconcile  string          `json:"reconcile"`
+	Fields     json.RawMessage `json:"fields"`
+	Children   ChildrenDelayed `json:"children"`
+	ExtraProps string          `json:"extra_props"`
+}
+
+// Child explodes the array at Path into rows of its own table. Each row
+// holds Fields read from one element, the parent's _id in ParentKey and
+// the element's position in IndexKey.
+type Child struct {
+	Path      string `json:"path"`
+	PgTable   string `json:"pg_table"`
+	PgSchema  string `json:"pg_schema"`
+	ParentKey string `json:"parent_key"`
+	IndexKey  string `json:"index_key"`
+	Fields    Fields `json:"fields"`
+}
+
+type ChildDelayed struct {
+	PgTable   string          `json:"pg_table"`
+	PgSchema  string          `json:"pg_schema"`
+	ParentKey string          `json:"parent_key"`
+	IndexKey  string          `json:"index_key"`
+	Fields    json.RawMessage `json:"fields"`
+}
+
+// ChildrenDelayed is keyed by the array's path
+type ChildrenDelayed map[string]ChildDelayed
+
+// defaultSchema is used for tables without a configured pg_schema
+const defaultSchema = "public"
+
+func (c Collection) pgSchema() string {
+	if c.PgSchema == "" {
+		return defaultSchema
+	}
+	return c.PgSchema
 }
 
+// pgTableQuoted is schema qualified when pg_schema is configured,
+// otherwise left to the connection's search_path
 func (c Collection) pgTableQuoted() string {
-	return fmt.Sprintf(`"%s"`, c.PgTable)
+	if c.PgSchema == "" {
+		return fmt.Sprintf(`"%s"`, c.PgTable)
+	}
+	return fmt.Sprintf(`"%s"."%s"`, c.PgSchema, c.PgTable)
 }
 
 type DBDelayed struct {
+	PgSchema    string             `json:"pg_schema"`
 	Collections CollectionsDelayed `json:"collections"`
 }
 type DB struct {
+	PgSchema    string      `json:"pg_schema"`
 	Collections Collections `json:"collections"`
 }
 
@@ -355,6 +679,9 @@ func (o *Statement) mongoFields() []string {
 	var fields []string
 	for _, k := range o.sortedKeys() {
 		v := o.Collection.Fields[k]
+		if v.isExtraProps() || v.isComputed() {
+			continue
+		}
 		fields = append(fields, v.Mongo.Name)
 	}
 	return fields
@@ -449,3 +776,218 @@ func (o *Statement) BuildUpdate() string {
 func (o *Statement) BuildDelete() string {
 	return fmt.Sprintf("DELETE FROM %s %s;", o.Collection.pgTableQuoted(), o.whereById())
 }
+
+// maxBindParameters is the Postgres limit on bind parameters per statement
+const maxBindParameters = 65535
+
+// BatchRowLimit is the largest number of rows a single BuildBatchUpsert
+// statement can hold for this collection without exceeding maxBindParameters
+func (o *Statement) BatchRowLimit() int {
+	return maxBindParameters / len(o.Collection.Fields)
+}
+
+func (o *Statement) positionalPlaceholders(offset int, count int) string {
+	var placeholders []string
+	for i := 1; i <= count; i++ {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", offset+i))
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+func (o *Statement) buildExcludedAssignment() string {
+	set := []string{}
+	for _, k := range o.sortedKeys() {
+		v := o.Collection.Fields[k]
+		if k != "_id" {
+			set = append(set, fmt.Sprintf(`%s = EXCLUDED.%s`, v.Postgres.nameQuoted(), v.Postgres.nameQuoted()))
+		}
+	}
+	return strings.Join(set, ", ")
+}
+
+// BuildBatchUpsert builds a multi row upsert for rows records using
+// positional placeholders. Arguments are supplied by BatchUpsertArgs.
+func (o *Statement) BuildBatchUpsert(rows int) string {
+	columns := len(o.Collection.Fields)
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), strings.Join(o.postgresFieldsQuoted(), ", "))
+	var values []string
+	for i := 0; i < rows; i++ {
+		values = append(values, fmt.Sprintf("(%s)", o.positionalPlaceholders(i*columns, columns)))
+	}
+	onConflict := fmt.Sprintf("ON CONFLICT (%s)", o.id().Postgres.nameQuoted())
+	doUpdate := fmt.Sprintf("DO UPDATE SET %s;", o.buildExcludedAssignment())
+	return o.joinLines(insertInto, fmt.Sprintf("VALUES %s", strings.Join(values, ",\n")), onConflict, doUpdate)
+}
+
+// BatchUpsertArgs flattens sanitized rows into the argument order
+// expected by BuildBatchUpsert
+func (o *Statement) BatchUpsertArgs(rows []map[string]interface{}) []interface{} {
+	var args []interface{}
+	for _, data := range rows {
+		for _, f := range o.postgresFields() {
+			args = append(args, data[f])
+		}
+	}
+	return args
+}
+
+// BuildSelectIds pages through the ids of the table in order, starting
+// after $1 when after is true. The page size is the last parameter.
+func (o *Statement) BuildSelectIds(after bool) string {
+	id := o.id().Postgres.nameQuoted()
+	if after {
+		return fmt.Sprintf(`SELECT %s::text FROM %s WHERE %s > $1 ORDER BY %s LIMIT $2;`, id, o.Collection.pgTableQuoted(), id, id)
+	}
+	return fmt.Sprintf(`SELECT %s::text FROM %s ORDER BY %s LIMIT $1;`, id, o.Collection.pgTableQuoted(), id)
+}
+
+// verifyFields are the fields of the table in the order verify renders them
+func (o *Statement) verifyFields() []Field {
+	var fields []Field
+	for _, k := range o.sortedKeys() {
+		fields = append(fields, o.Collection.Fields[k])
+	}
+	return fields
+}
+
+// verifyRowSQL renders every column of fields, in order, as length prefixed
+// text. Rows and documents are both rendered by Postgres, documents cast to
+// the column types as on write, so they agree whenever the values do.
+func (o *Statement) verifyRowSQL() string {
+	var columns []string
+	for _, f := range o.verifyFields() {
+		c := f.Postgres.nameQuoted()
+		columns = append(columns, fmt.Sprintf(`CASE WHEN %[1]s IS NULL THEN 'N' ELSE 'V' || length(%[1]s::text) || ':' || %[1]s::text END`, c))
+	}
+	return strings.Join(columns, " || ")
+}
+
+// verifyValues is a VALUES list of rows documents, numbered from 0 in
+// moresql_row, with arguments supplied by BatchUpsertArgs
+func (o *Statement) verifyValues(rows int) string {
+	fields := o.verifyFields()
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Postgres.nameQuoted())
+	}
+	var values []string
+	for i := 0; i < rows; i++ {
+		row := []string{strconv.Itoa(i)}
+		for j, f := range fields {
+			p := fmt.Sprintf("$%d", i*len(fields)+j+1)
+			if f.Postgres.Type != "" {
+				p = fmt.Sprintf("%s::%s", p, f.Postgres.Type)
+			}
+			row = append(row, p)
+		}
+		values = append(values, fmt.Sprintf("(%s)", strings.Join(row, ", ")))
+	}
+	return fmt.Sprintf(`(VALUES %s) AS v(moresql_row, %s)`, strings.Join(values, ", "), strings.Join(names, ", "))
+}
+
+// idCollated compares text ids bytewise, the order Mongo sorts strings in
+func (o *Statement) idCollated() string {
+	id := o.id().Postgres
+	t := strings.ToLower(strings.TrimSpace(id.Type))
+	for _, text := range []string{"text", "char", "varchar"} {
+		if strings.HasPrefix(t, text) {
+			return fmt.Sprintf(`%s COLLATE "C"`, id.nameQuoted())
+		}
+	}
+	return id.nameQuoted()
+}
+
+// verifyDigest counts the rows rendered by verifyRowSQL from source along
+// with the md5 of the rows concatenated in byte order
+func (o *Statement) verifyDigest(source string) string {
+	return fmt.Sprintf(`SELECT count(*) AS count, coalesce(md5(string_agg(row, '' ORDER BY row COLLATE "C")), '') AS digest FROM (SELECT %s AS row FROM %s) AS rows;`, o.verifyRowSQL(), source)
+}
+
+// BuildVerifyRange counts the rows with ids from $1, and before $2 when
+// upper is true, along with the md5 of their rendered rows
+func (o *Statement) BuildVerifyRange(upper bool) string {
+	where := fmt.Sprintf(`%s >= $1`, o.idCollated())
+	if upper {
+		where = fmt.Sprintf(`%s AND %s < $2`, where, o.idCollated())
+	}
+	return o.verifyDigest(fmt.Sprintf(`%s WHERE %s`, o.Collection.pgTableQuoted(), where))
+}
+
+// BuildVerifyDocuments digests rows documents as BuildVerifyRange digests
+// the stored rows
+func (o *Statement) BuildVerifyDocuments(rows int) string {
+	return o.verifyDigest(o.verifyValues(rows))
+}
+
+// BuildVerifyDocumentRows renders rows documents one by one, with the id
+// as Postgres stores it and the document's position in moresql_row
+func (o *Statement) BuildVerifyDocumentRows(rows int) string {
+	return fmt.Sprintf(`SELECT moresql_row AS n, %s::text AS id, %s AS doc FROM %s;`, o.id().Postgres.nameQuoted(), o.verifyRowSQL(), o.verifyValues(rows))
+}
+
+// BuildVerifyRows selects the id and rendered row of rows records,
+// matched by id with positional placeholders
+func (o *Statement) BuildVerifyRows(rows int) string {
+	id := o.id().Postgres.nameQuoted()
+	return fmt.Sprintf(`SELECT %s::text AS id, %s AS doc FROM %s WHERE %s IN (%s);`, id, o.verifyRowSQL(), o.Collection.pgTableQuoted(), id, o.positionalPlaceholders(0, rows))
+}
+
+// BuildCount counts the rows of the table
+func (o *Statement) BuildCount() string {
+	return fmt.Sprintf(`SELECT count(*) FROM %s;`, o.Collection.pgTableQuoted())
+}
+
+// stagingTable is the temporary table -bulk-copy loads rows into
+const stagingTable = "moresql_staging"
+
+// BuildCreateStaging creates a temporary copy of the target table,
+// dropped when the transaction commits
+func (o *Statement) BuildCreateStaging() string {
+	return fmt.Sprintf(`CREATE TEMP TABLE "%s" (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP;`, stagingTable, o.Collection.pgTableQuoted())
+}
+
+// BuildMergeStaging upserts the rows copied into the staging table
+// into the target table. ON CONFLICT may not update the same row twice
+// in one statement, rows are copied once per id after CollapseRows.
+func (o *Statement) BuildMergeStaging() string {
+	fields := strings.Join(o.postgresFieldsQuoted(), ", ")
+	id := o.id().Postgres.nameQuoted()
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), fields)
+	selectFrom := fmt.Sprintf(`SELECT %s FROM "%s"`, fields, stagingTable)
+	onConflict := fmt.Sprintf("ON CONFLICT (%s)", id)
+	doUpdate := fmt.Sprintf("DO UPDATE SET %s;", o.buildExcludedAssignment())
+	return o.joinLines(insertInto, selectFrom, onConflict, doUpdate)
+}
+
+// BuildBatchInsert builds a multi row insert for rows records using
+// positional placeholders. Arguments are supplied by BatchUpsertArgs.
+func (o *Statement) BuildBatchInsert(rows int) string {
+	columns := len(o.Collection.Fields)
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), strings.Join(o.postgresFieldsQuoted(), ", "))
+	var values []string
+	for i := 0; i < rows; i++ {
+		values = append(values, fmt.Sprintf("(%s)", o.positionalPlaceholders(i*columns, columns)))
+	}
+	return o.joinLines(insertInto, fmt.Sprintf("VALUES %s;", strings.Join(values, ",\n")))
+}
+
+// BuildBatchDelete builds a delete for rows records using positional
+// placeholders. Arguments are supplied by BatchDeleteArgs.
+func (o *Statement) BuildBatchDelete(rows int) string {
+	return o.BuildBatchDeleteBy(o.id().Postgres, rows)
+}
+
+// BuildBatchDeleteBy deletes the rows whose column matches any of rows
+// positional placeholders
+func (o *Statement) BuildBatchDeleteBy(column Postgres, rows int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s);", o.Collection.pgTableQuoted(), column.nameQuoted(), o.positionalPlaceholders(0, rows))
+}
+
+// BatchDeleteArgs extracts the ids expected by BuildBatchDelete
+func (o *Statement) BatchDeleteArgs(rows []map[string]interface{}) []interface{} {
+	var args []interface{}
+	for _, data := range rows {
+		args = append(args, data[o.id().Mongo.Name])
+	}
+	return args
+}
@@ -18,3 +18,12 @@ func (s *MySuite) TestUseSSL(c *C) {
 		c.Check(actual, DeepEquals, t.result)
 	}
 }
+
+func (s *MySuite) TestQueriesSchemaQualifyMetadataTables(c *C) {
+	q := m.Queries{Schema: "moresql"}
+	c.Check(q.GetMetadata(), Matches, `SELECT \* FROM "moresql"."moresql_metadata" .*`)
+	c.Check(q.DeleteDeadLetter(), Equals, `DELETE FROM "moresql"."moresql_dead_letters" WHERE id=$1;`)
+
+	q = m.Queries{}
+	c.Check(q.DeleteDeadLetter(), Equals, `DELETE FROM "public"."moresql_dead_letters" WHERE id=$1;`)
+}
@@ -0,0 +1,346 @@
+package moresql
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// syncProgressInterval is the number of documents full sync reads from a
+// range between saves of its progress
+const syncProgressInterval = 5000
+
+// syncSamplesPerPartition is how many _ids are sampled for each range
+// boundary, more samples give more even ranges
+const syncSamplesPerPartition = 20
+
+// syncMinPartitionSize is the smallest estimated range worth a cursor of its own
+const syncMinPartitionSize = 10000
+
+// SyncProgress is the full sync position within one _id range of a collection
+type SyncProgress struct {
+	AppName     string         `db:"app_name"`
+	Namespace   string         `db:"namespace"`
+	RangeIndex  int            `db:"range_index"`
+	RangeMin    sql.NullString `db:"range_min"`
+	RangeMax    sql.NullString `db:"range_max"`
+	LastId      sql.NullString `db:"last_id"`
+	Synced      int64          `db:"synced"`
+	Total       int64          `db:"total"`
+	CompletedAt pq.NullTime    `db:"completed_at"`
+	UpdatedAt   time.Time      `db:"updated_at"`
+}
+
+// Percent estimates how much of the collection has been synced
+func (p SyncProgress) Percent() float64 {
+	if p.CompletedAt.Valid {
+		return 100
+	}
+	if p.Total <= 0 {
+		return 0
+	}
+	percent := float64(p.Synced) * 100 / float64(p.Total)
+	// Total is an estimate taken when the sync started
+	if percent > 99.9 {
+		return 99.9
+	}
+	return percent
+}
+
+// SummarizeSyncProgress combines the ranges of each collection into
+// a single SyncProgress per namespace, keeping their order
+func SummarizeSyncProgress(rows []SyncProgress) []SyncProgress {
+	var summaries []SyncProgress
+	byNamespace := make(map[string]int)
+	for _, r := range rows {
+		i, ok := byNamespace[r.Namespace]
+		if !ok {
+			byNamespace[r.Namespace] = len(summaries)
+			r.RangeIndex, r.RangeMin, r.RangeMax, r.LastId = 0, sql.NullString{}, sql.NullString{}, sql.NullString{}
+			summaries = append(summaries, r)
+			continue
+		}
+		s := &summaries[i]
+		s.Synced += r.Synced
+		if r.Total > s.Total {
+			s.Total = r.Total
+		}
+		if !r.CompletedAt.Valid {
+			s.CompletedAt = pq.NullTime{}
+		} else if s.CompletedAt.Valid && r.CompletedAt.Time.After(s.CompletedAt.Time) {
+			s.CompletedAt = r.CompletedAt
+		}
+		if r.UpdatedAt.After(s.UpdatedAt) {
+			s.UpdatedAt = r.UpdatedAt
+		}
+	}
+	return summaries
+}
+
+type syncId struct {
+	Id interface{} `json:"_id"`
+}
+
+// EncodeSyncId stores a Mongo _id as extended JSON so its type survives the round trip
+func EncodeSyncId(id interface{}) (string, error) {
+	b, err := bson.MarshalJSON(syncId{id})
+	return string(b), err
+}
+
+// DecodeSyncId reverses EncodeSyncId
+func DecodeSyncId(s string) (interface{}, error) {
+	var id syncId
+	err := bson.UnmarshalJSON([]byte(s), &id)
+	return id.Id, err
+}
+
+func encodeNullSyncId(id interface{}) (sql.NullString, error) {
+	if id == nil {
+		return sql.NullString{}, nil
+	}
+	s, err := EncodeSyncId(id)
+	return sql.NullString{String: s, Valid: err == nil}, err
+}
+
+func decodeNullSyncId(s sql.NullString) (interface{}, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	return DecodeSyncId(s.String)
+}
+
+// RangeFilter restricts filter to documents with min <= _id < max which come
+// after lastId. A nil bound or lastId is not applied. Mongo compares _id only
+// within the same BSON type, so the first range, which has no min, takes every
+// _id not at or above max to include _ids of other types.
+func RangeFilter(filter interface{}, min interface{}, max interface{}, lastId interface{}) interface{} {
+	var clauses []interface{}
+	if filter != nil {
+		clauses = append(clauses, filter)
+	}
+	switch {
+	case min == nil && max != nil:
+		clauses = append(clauses, bson.M{"_id": bson.M{"$not": bson.M{"$gte": max}}})
+	case min != nil && max == nil:
+		clauses = append(clauses, bson.M{"_id": bson.M{"$gte": min}})
+	case min != nil && max != nil:
+		clauses = append(clauses, bson.M{"_id": bson.M{"$gte": min, "$lt": max}})
+	}
+	if lastId != nil {
+		clauses = append(clauses, bson.M{"_id": bson.M{"$gt": lastId}})
+	}
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		return clauses[0]
+	}
+	return bson.M{"$and": clauses}
+}
+
+// PartitionBoundaries picks up to partitions-1 boundaries from sorted sampled
+// _ids, splitting the collection into ranges of roughly equal size
+func PartitionBoundaries(sorted []interface{}, partitions int) []interface{} {
+	var boundaries []interface{}
+	if partitions < 2 || len(sorted) == 0 {
+		return boundaries
+	}
+	for i := 1; i < partitions; i++ {
+		b := sorted[i*len(sorted)/partitions]
+		if len(boundaries) > 0 && reflect.DeepEqual(boundaries[len(boundaries)-1], b) {
+			continue
+		}
+		boundaries = append(boundaries, b)
+	}
+	return boundaries
+}
+
+// sampleBoundaries uses $sample rather than splitVector as it needs no
+// extra privileges and works through mongos
+func sampleBoundaries(coll *mgo.Collection, filter interface{}, total int, partitions int) []interface{} {
+	if partitions > total/syncMinPartitionSize {
+		partitions = total / syncMinPartitionSize
+	}
+	if partitions < 2 {
+		return nil
+	}
+	var pipeline []bson.M
+	if filter != nil {
+		pipeline = append(pipeline, bson.M{"$match": filter})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$sample": bson.M{"size": partitions * syncSamplesPerPartition}},
+		bson.M{"$project": bson.M{"_id": 1}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	)
+	var samples []syncId
+	if err := coll.Pipe(pipeline).AllowDiskUse().All(&samples); err != nil {
+		log.Warnf("Unable to sample %s, reading it with a single cursor: %s", coll.FullName, err)
+		return nil
+	}
+	var sorted []interface{}
+	for _, s := range samples {
+		sorted = append(sorted, s.Id)
+	}
+	return PartitionBoundaries(sorted, partitions)
+}
+
+// syncRange is an _id range of a collection read by a single cursor
+type syncRange struct {
+	db       string
+	name     string
+	filter   interface{}
+	min      interface{}
+	max      interface{}
+	lastId   interface{}
+	progress SyncProgress
+	// pending counts documents read from the range but not yet written
+	pending sync.WaitGroup
+}
+
+// syncProgressStore persists SyncProgress. A nil store keeps no progress.
+type syncProgressStore struct {
+	sync.Mutex
+	pg      *sqlx.DB
+	q       Queries
+	appName string
+	rows    map[string][]SyncProgress
+}
+
+func newSyncProgressStore(pg *sqlx.DB, env Env) (*syncProgressStore, error) {
+	s := &syncProgressStore{pg: pg, q: Queries{Schema: env.metadataSchema}, appName: env.appName, rows: make(map[string][]SyncProgress)}
+	if _, err := pg.Exec(s.q.CreateSyncProgressTable()); err != nil {
+		return nil, err
+	}
+	var rows []SyncProgress
+	if err := pg.Select(&rows, s.q.GetSyncProgress(), env.appName); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		s.rows[r.Namespace] = append(s.rows[r.Namespace], r)
+	}
+	return s, nil
+}
+
+// Get returns the ranges recorded for namespace, in order
+func (s *syncProgressStore) Get(namespace string) []SyncProgress {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return append([]SyncProgress(nil), s.rows[namespace]...)
+}
+
+func (s *syncProgressStore) Save(p SyncProgress) {
+	if s == nil {
+		return
+	}
+	p.UpdatedAt = time.Now()
+	s.Lock()
+	rows := s.rows[p.Namespace]
+	for len(rows) <= p.RangeIndex {
+		rows = append(rows, SyncProgress{})
+	}
+	rows[p.RangeIndex] = p
+	s.rows[p.Namespace] = rows
+	s.Unlock()
+	if _, err := s.pg.NamedExec(s.q.SaveSyncProgress(), p); err != nil {
+		log.Errorf("Unable to save full sync progress for %s range %d: %s", p.Namespace, p.RangeIndex, err.Error())
+	}
+}
+
+// InProgress is true when a full sync started but has not completed
+func (s *syncProgressStore) InProgress() bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, rows := range s.rows {
+		for _, r := range rows {
+			if !r.CompletedAt.Valid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResetIfComplete discards the progress of namespaces when every range of each
+// finished syncing, so that a new full sync starts over rather than doing
+// nothing. Progress of other namespaces is kept.
+func (s *syncProgressStore) ResetIfComplete(namespaces []string) error {
+	if s == nil || len(namespaces) == 0 {
+		return nil
+	}
+	for _, ns := range namespaces {
+		rows := s.Get(ns)
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, r := range rows {
+			if !r.CompletedAt.Valid {
+				return nil
+			}
+		}
+	}
+	log.Info("Previous full sync completed, starting a new one")
+	return s.Reset(namespaces)
+}
+
+// Reset discards the progress of namespaces so that their full sync starts over
+func (s *syncProgressStore) Reset(namespaces []string) error {
+	if s == nil || len(namespaces) == 0 {
+		return nil
+	}
+	if _, err := s.pg.Exec(s.q.ResetSyncProgress(), s.appName, PostgresTextArray(namespaces)); err != nil {
+		return err
+	}
+	s.Lock()
+	for _, ns := range namespaces {
+		delete(s.rows, ns)
+	}
+	s.Unlock()
+	return nil
+}
+
+// PostgresTextArray renders values as a text[] literal, the lib/pq in use
+// predates pq.Array
+func PostgresTextArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		v = strings.Replace(v, `\`, `\\`, -1)
+		quoted[i] = `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// FullSyncStatus prints the progress of each collection in the current or last full sync
+func FullSyncStatus(pg *sqlx.DB, env Env) {
+	q := Queries{Schema: env.metadataSchema}
+	var rows []SyncProgress
+	if err := pg.Select(&rows, q.GetSyncProgress(), env.appName); err != nil {
+		log.Fatalf("Unable to read moresql_sync_progress: %s", err.Error())
+	}
+	if len(rows) == 0 {
+		fmt.Println("No full sync progress recorded")
+		return
+	}
+	for _, r := range SummarizeSyncProgress(rows) {
+		state := "in progress"
+		if r.CompletedAt.Valid {
+			state = fmt.Sprintf("completed at %s", r.CompletedAt.Time.Format(time.RFC3339))
+		}
+		fmt.Printf("%s: %.1f%% (%d of ~%d documents) %s, updated %s\n", r.Namespace, r.Percent(), r.Synced, r.Total, state, r.UpdatedAt.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,83 @@
+package moresql_test
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *MySuite) TestSyncIdRoundTrip(c *C) {
+	for _, id := range []interface{}{bson.ObjectIdHex("58e52d2d6c5bd6a8f1c8a7a1"), "abc", int64(1) << 60, 4.5} {
+		encoded, err := m.EncodeSyncId(id)
+		c.Assert(err, IsNil)
+		decoded, err := m.DecodeSyncId(encoded)
+		c.Assert(err, IsNil)
+		c.Check(decoded, DeepEquals, id)
+	}
+}
+
+func (s *MySuite) TestRangeFilter(c *C) {
+	c.Check(m.RangeFilter(nil, nil, nil, nil), IsNil)
+	filter := bson.M{"active": true}
+	c.Check(m.RangeFilter(filter, nil, nil, nil), DeepEquals, filter)
+	c.Check(m.RangeFilter(nil, nil, nil, "a"), DeepEquals, bson.M{"_id": bson.M{"$gt": "a"}})
+	c.Check(m.RangeFilter(filter, nil, nil, "a"), DeepEquals, bson.M{"$and": []interface{}{filter, bson.M{"_id": bson.M{"$gt": "a"}}}})
+	c.Check(m.RangeFilter(nil, "b", "d", nil), DeepEquals, bson.M{"_id": bson.M{"$gte": "b", "$lt": "d"}})
+	c.Check(m.RangeFilter(nil, "b", nil, nil), DeepEquals, bson.M{"_id": bson.M{"$gte": "b"}})
+	// The first range also takes _ids of other types
+	c.Check(m.RangeFilter(nil, nil, "b", nil), DeepEquals, bson.M{"_id": bson.M{"$not": bson.M{"$gte": "b"}}})
+	c.Check(m.RangeFilter(filter, "b", "d", "c"), DeepEquals, bson.M{"$and": []interface{}{
+		filter,
+		bson.M{"_id": bson.M{"$gte": "b", "$lt": "d"}},
+		bson.M{"_id": bson.M{"$gt": "c"}},
+	}})
+}
+
+func (s *MySuite) TestPartitionBoundaries(c *C) {
+	sorted := []interface{}{1, 2, 3, 4, 5, 6, 7, 8}
+	c.Check(m.PartitionBoundaries(sorted, 1), HasLen, 0)
+	c.Check(m.PartitionBoundaries(nil, 4), HasLen, 0)
+	c.Check(m.PartitionBoundaries(sorted, 4), DeepEquals, []interface{}{3, 5, 7})
+	// Repeated samples do not produce empty ranges
+	c.Check(m.PartitionBoundaries([]interface{}{1, 1, 1, 2}, 4), DeepEquals, []interface{}{1, 2})
+}
+
+func (s *MySuite) TestSummarizeSyncProgress(c *C) {
+	now := time.Now()
+	done := pq.NullTime{Time: now, Valid: true}
+	rows := []m.SyncProgress{
+		{Namespace: "app.users", RangeIndex: 0, Synced: 10, Total: 100, CompletedAt: done, UpdatedAt: now},
+		{Namespace: "app.users", RangeIndex: 1, Synced: 15, Total: 100, UpdatedAt: now.Add(time.Second)},
+		{Namespace: "app.orders", Synced: 5, Total: 5, CompletedAt: done, UpdatedAt: now},
+	}
+	summary := m.SummarizeSyncProgress(rows)
+	c.Assert(summary, HasLen, 2)
+	c.Check(summary[0].Namespace, Equals, "app.users")
+	c.Check(summary[0].Synced, Equals, int64(25))
+	c.Check(summary[0].CompletedAt.Valid, Equals, false)
+	c.Check(summary[0].UpdatedAt, Equals, now.Add(time.Second))
+	c.Check(summary[1].Percent(), Equals, float64(100))
+}
+
+func (s *MySuite) TestSyncProgressPercent(c *C) {
+	c.Check(m.SyncProgress{}.Percent(), Equals, float64(0))
+	c.Check(m.SyncProgress{Synced: 25, Total: 100}.Percent(), Equals, float64(25))
+	// Total is an estimate so can be exceeded before completion
+	c.Check(m.SyncProgress{Synced: 120, Total: 100}.Percent(), Equals, 99.9)
+	done := m.SyncProgress{Synced: 10, Total: 100, CompletedAt: pq.NullTime{Time: time.Now(), Valid: true}}
+	c.Check(done.Percent(), Equals, float64(100))
+}
+
+func (s *MySuite) TestPostgresTextArray(c *C) {
+	c.Check(m.PostgresTextArray([]string{"db.users", "db.orders"}), Equals, `{"db.users","db.orders"}`)
+	c.Check(m.PostgresTextArray([]string{`a"b`, `c\d`}), Equals, `{"a\"b","c\\d"}`)
+	c.Check(m.PostgresTextArray(nil), Equals, `{}`)
+}
+
+func (s *MySuite) TestResetSyncProgressIsScopedToNamespaces(c *C) {
+	q := m.Queries{}
+	c.Check(q.ResetSyncProgress(), Equals, `DELETE FROM "public"."moresql_sync_progress" WHERE app_name=$1 AND namespace = ANY($2::text[]);`)
+}
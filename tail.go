@@ -4,13 +4,15 @@ import (
 	"database/sql"
 	"expvar"
 	"fmt"
+	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
-	"github.com/orcaman/concurrent-map"
 	"github.com/paulbellamy/ratecounter"
 	"github.com/rwynn/gtm"
 	"github.com/serialx/hashring"
@@ -25,14 +27,20 @@ import (
 // Tailer is the core struct for performing
 // Mongo->Pg streaming.
 type Tailer struct {
-	config     Config
-	pg         *sqlx.DB
-	session    *mgo.Session
-	env        Env
-	counters   counters
-	stop       chan bool
-	fan        map[string]gtm.OpChan
-	checkpoint *cmap.ConcurrentMap
+	config    Config
+	pg        *sqlx.DB
+	sink      Sink
+	session   *mgo.Session
+	env       Env
+	counters  counters
+	stop      chan bool
+	draining  chan bool
+	fan       map[string]gtm.OpChan
+	watermark *Watermark
+	tokens    *resumeTokens
+	backoff   Backoff
+	gate      *pauseGate
+	workers   *workerStates
 }
 
 // Stop is the func necessary to terminate action
@@ -44,7 +52,7 @@ func (t *Tailer) Stop() {
 
 func (t *Tailer) startOverflowConsumers(c <-chan *gtm.Op) {
 	for i := 1; i <= workerCountOverflow; i++ {
-		go t.consumer(strconv.Itoa(i), c, nil)
+		go t.consumer("overflow/"+strconv.Itoa(i), c, nil)
 	}
 }
 
@@ -57,25 +65,47 @@ func BuildOptionAfterFromTimestamp(timestamp EpochTimestamp, replayDuration time
 		return OpTimestampWrapper(f, time.Duration(0)), nil
 	} else if replayDuration != time.Duration(0) {
 		return OpTimestampWrapper(bson.Now, replayDuration), nil
-	} else {
-		return OpTimestampWrapper(bson.Now, time.Duration(0)), nil
 	}
-	return nil, fmt.Errorf("Unable to calculate tailing start time")
+	return OpTimestampWrapper(bson.Now, time.Duration(0)), nil
+}
+
+// BuildOptionAfterFromMongoTimestamp tails strictly after ts, keeping its increment
+// so that ops sharing ts's second are neither replayed nor skipped. Falls back
+// to replayDuration when ts is unset or in the future.
+func BuildOptionAfterFromMongoTimestamp(ts bson.MongoTimestamp, replayDuration time.Duration) (func(*mgo.Session, *gtm.Options) bson.MongoTimestamp, error) {
+	epoch, _ := gtm.ParseTimestamp(ts)
+	if ts != bson.MongoTimestamp(0) && int64(epoch) < time.Now().Unix() {
+		return func(*mgo.Session, *gtm.Options) bson.MongoTimestamp { return ts }, nil
+	}
+	return BuildOptionAfterFromTimestamp(EpochTimestamp(0), replayDuration)
 }
 
 func (t *Tailer) NewOptions(timestamp EpochTimestamp, replayDuration time.Duration) (*gtm.Options, error) {
-	options := gtm.DefaultOptions()
 	after, err := BuildOptionAfterFromTimestamp(timestamp, replayDuration)
 	if err != nil {
 		return nil, err
 	}
-	epoch, _ := gtm.ParseTimestamp(after(nil, nil))
-	log.Infof("Starting from epoch: %+v", epoch)
+	return t.newOptions(after), nil
+}
+
+// NewOptionsFromMongoTimestamp is NewOptions for a full precision oplog position
+func (t *Tailer) NewOptionsFromMongoTimestamp(ts bson.MongoTimestamp, replayDuration time.Duration) (*gtm.Options, error) {
+	after, err := BuildOptionAfterFromMongoTimestamp(ts, replayDuration)
+	if err != nil {
+		return nil, err
+	}
+	return t.newOptions(after), nil
+}
+
+func (t *Tailer) newOptions(after func(*mgo.Session, *gtm.Options) bson.MongoTimestamp) *gtm.Options {
+	options := gtm.DefaultOptions()
+	epoch, increment := gtm.ParseTimestamp(after(nil, nil))
+	log.Infof("Starting after epoch: %d increment: %d", epoch, increment)
 	options.After = after
 	options.BufferSize = 500
 	options.BufferDuration = time.Duration(500 * time.Millisecond)
 	options.Ordering = gtm.Document
-	return options, nil
+	return options
 }
 
 func (t *Tailer) NewFan() map[string]gtm.OpChan {
@@ -120,8 +150,13 @@ func (t *Tailer) startDedicatedConsumers(fan map[string]gtm.OpChan, overflow gtm
 		ring := hashring.New(keys)
 		wg.Add(1)
 		go consistentBroker(c, ring, workerPool)
-		for k, workerChan := range workerPool {
-			go t.consumer(k, workerChan, overflow)
+		for i, workerChan := range workerPool {
+			id := k + "/" + i
+			if t.env.batchSize > 1 {
+				go t.batchConsumer(id, workerChan)
+			} else {
+				go t.consumer(id, workerChan, overflow)
+			}
 		}
 		log.WithFields(log.Fields{
 			"count":      workerCount,
@@ -131,26 +166,50 @@ func (t *Tailer) startDedicatedConsumers(fan map[string]gtm.OpChan, overflow gtm
 }
 
 type MoresqlMetadata struct {
-	AppName     string    `db:"app_name"`
-	LastEpoch   int64     `db:"last_epoch"`
-	ProcessedAt time.Time `db:"processed_at"`
+	AppName       string         `db:"app_name"`
+	LastEpoch     int64          `db:"last_epoch"`
+	LastTimestamp int64          `db:"last_timestamp"`
+	ResumeToken   sql.NullString `db:"resume_token"`
+	ProcessedAt   time.Time      `db:"processed_at"`
+}
+
+// Position is the oplog timestamp to resume tailing after.
+// Checkpoints written before last_timestamp existed only hold
+// the second, so the whole of that second is replayed.
+func (m MoresqlMetadata) Position() bson.MongoTimestamp {
+	if m.LastTimestamp != 0 {
+		return bson.MongoTimestamp(m.LastTimestamp)
+	}
+	return bson.MongoTimestamp(m.LastEpoch << 32)
 }
 
 func NewTailer(config Config, pg *sqlx.DB, session *mgo.Session, env Env) *Tailer {
-	checkpoint := cmap.New()
-	return &Tailer{config: config, pg: pg, session: session, env: env, stop: make(chan bool), counters: buildCounters(), checkpoint: &checkpoint}
+	return &Tailer{config: config, pg: pg, sink: NewPostgresSink(pg, env.metadataSchema), session: session, env: env, stop: make(chan bool), draining: make(chan bool), counters: buildCounters(), watermark: NewWatermark(), tokens: newResumeTokens(), backoff: NewBackoff(env.retryAttempts, env.retryMaxBackoff), gate: &pauseGate{}, workers: newWorkerStates()}
+}
+
+// NewTailerWithSink builds a Tailer which applies operations to sink
+// rather than the default PostgresSink. pg is still used for reading
+// checkpoints from moresql_metadata.
+func NewTailerWithSink(config Config, pg *sqlx.DB, sink Sink, session *mgo.Session, env Env) *Tailer {
+	t := NewTailer(config, pg, session, env)
+	t.sink = sink
+	return t
 }
 
-func FetchMetadata(checkpoint bool, pg *sqlx.DB, appName string) MoresqlMetadata {
+func FetchMetadata(checkpoint bool, pg *sqlx.DB, appName string, schema string) MoresqlMetadata {
 	metadata := MoresqlMetadata{}
 	if checkpoint {
-		q := Queries{}
+		q := Queries{Schema: schema}
+		// Older installs predate resume_token and last_timestamp
+		if _, err := pg.Exec(q.MigrateMetadataTable()); err != nil {
+			log.Errorf("Unable to migrate moresql_metadata table %+v", err)
+		}
 		err := pg.Get(&metadata, q.GetMetadata(), appName)
 		// No rows means this is first time with table
 		if err != nil && err != sql.ErrNoRows {
 			log.Errorf("Error while reading moresql_metadata table %+v", err)
 			c := Commands{}
-			c.CreateTableSQL()
+			c.CreateTableSQL(schema)
 		}
 
 	} else {
@@ -164,44 +223,72 @@ type gtmTail struct {
 	errs chan error
 }
 
+// startSource begins reading after position from the source selected by -source.
+// A non empty change stream resume token takes precedence over position.
+func (t *Tailer) startSource(position bson.MongoTimestamp, token string) (gtmTail, error) {
+	options, err := t.NewOptionsFromMongoTimestamp(position, t.env.replayDuration)
+	if err != nil {
+		return gtmTail{}, err
+	}
+	if t.env.source == sourceChangeStream {
+		var after bson.MongoTimestamp
+		if token == "" {
+			// startAtOperationTime is inclusive where the oplog query is not
+			after = options.After(nil, nil) + 1
+		}
+		log.Info("Tailing mongo change stream")
+		ops, errs := changeStreamTail(t.session, token, after, t.tokens)
+		return gtmTail{ops, errs}, nil
+	}
+	log.Info("Tailing mongo oplog")
+	ops, errs := gtm.Tail(t.session, options)
+	return gtmTail{ops, errs}, nil
+}
+
+// isRecoverable reports whether the source can be restarted
+// from the latest checkpoint after err
+func isRecoverable(err error) bool {
+	matched, _ := regexp.MatchString("i/o timeout|cursor closed by server", err.Error())
+	return matched
+}
+
 func (t *Tailer) Read() {
-	metadata := FetchMetadata(t.env.checkpoint, t.pg, t.env.appName)
+	metadata := FetchMetadata(t.env.checkpoint, t.pg, t.env.appName, t.env.metadataSchema)
 
-	var lastEpoch int64
-	if t.env.replaySecond != 0 {
-		lastEpoch = int64(t.env.replaySecond)
+	var position bson.MongoTimestamp
+	var token string
+	if t.env.replayTimestamp != 0 {
+		position = t.env.replayTimestamp
 	} else {
-		lastEpoch = metadata.LastEpoch
+		position = metadata.Position()
+		token = metadata.ResumeToken.String
 	}
-	options, err := t.NewOptions(EpochTimestamp(lastEpoch), t.env.replayDuration)
+	g, err := t.startSource(position, token)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	ops, errs := gtm.Tail(t.session, options)
-	g := gtmTail{ops, errs}
-	log.Info("Tailing mongo oplog")
 	go func() {
 		for {
 			select {
 			case <-t.stop:
 				return
+			case <-t.draining:
+				log.Info("Stopped reading from mongo")
+				return
 			case err := <-g.errs:
-				if matched, _ := regexp.MatchString("i/o timeout", err.Error()); matched {
-					// Restart gtm.Tail
+				if isRecoverable(err) {
+					// Restart source
 					// Close existing channels to not leak resources
 					log.Errorf("Problem connecting to mongo initiating reconnection: %s", err.Error())
 					close(g.ops)
 					close(g.errs)
-					latest, ok := t.checkpoint.Get("latest")
-					if ok && latest != nil {
-						metadata = latest.(MoresqlMetadata)
-						lastEpoch = metadata.LastEpoch
-						options, err := t.NewOptions(EpochTimestamp(lastEpoch), t.env.replayDuration)
+					latest, ok := t.watermark.Low()
+					if ok {
+						metadata = latest
+						g, err = t.startSource(metadata.Position(), metadata.ResumeToken.String)
 						if err != nil {
 							log.Fatal(err.Error())
 						}
-						ops, errs = gtm.Tail(t.session, options)
-						g = gtmTail{ops, errs}
 					} else {
 						log.Fatalf("Exiting: Unable to recover from %s", err.Error())
 					}
@@ -215,6 +302,10 @@ func (t *Tailer) Read() {
 					"collection": op.GetCollection(),
 					"id":         op.Id,
 				}).Debug("Received operation")
+				// Every op is tracked, including skipped ones,
+				// so the low-water mark advances past them
+				t.watermark.Add(op, t.OpToMoresqlMetadata(op))
+				t.tokens.Release(op)
 				// Check if we're watching for the collection
 				db := op.GetDatabase()
 				coll := op.GetCollection()
@@ -225,6 +316,7 @@ func (t *Tailer) Read() {
 					c <- EnsureOpHasAllFields(op, o.mongoFields())
 				} else {
 					t.counters.skipped.Incr(1)
+					t.watermark.Done(op)
 					log.Debug("Missing channel for this collection")
 				}
 				for k, v := range t.fan {
@@ -240,6 +332,7 @@ func (t *Tailer) Read() {
 func (t *Tailer) Write() {
 	t.fan = t.NewFan()
 	log.WithField("struct", t.fan).Debug("Fan")
+	metrics.Backlog(t.Backlog)
 	overflow := make(gtm.OpChan)
 	t.startDedicatedConsumers(t.fan, overflow)
 	t.startOverflowConsumers(overflow)
@@ -259,10 +352,11 @@ func (t *Tailer) Report() {
 }
 
 func (t *Tailer) SaveCheckpoint(m MoresqlMetadata) error {
-	q := Queries{}
-	result, err := t.pg.NamedExec(q.SaveMetadata(), m)
+	err := t.sink.Checkpoint(m)
 	if err != nil {
-		log.Errorf("Unable to save into moresql_metadata: %+v, %+v", result, err.Error())
+		log.Errorf("Unable to save into moresql_metadata: %+v", err.Error())
+	} else {
+		metrics.CheckpointSaved()
 	}
 	return err
 }
@@ -273,19 +367,51 @@ func (t *Tailer) Checkpoints() {
 		for {
 			select {
 			case _ = <-timer:
-				latest, ok := t.checkpoint.Get("latest")
-				if ok && latest != nil {
-					t.SaveCheckpoint(latest.(MoresqlMetadata))
-					log.Debug("Saved checkpointing %+v", latest.(MoresqlMetadata))
+				// Batched workers also save the checkpoint alongside their data,
+				// this covers unbatched workers and runs of skipped ops
+				latest, ok := t.watermark.Low()
+				if ok {
+					t.SaveCheckpoint(latest)
+					log.Debugf("Saved checkpointing %+v", latest)
 				}
 			}
 		}
 	}()
 }
 
+// Shutdown stops reading new ops, waits up to timeout for ops already read
+// to be applied by the workers, then saves a final checkpoint. Ops that are
+// still pending at the deadline are not included in the checkpoint and
+// will be replayed on the next start.
+func (t *Tailer) Shutdown(timeout time.Duration) {
+	close(t.draining)
+	// Paused workers would hold their ops until the timeout, apply them
+	// so that the final checkpoint covers them
+	if t.gate.Close() {
+		log.Info("Resumed applying ops to drain workers")
+	}
+	log.WithFields(log.Fields{
+		"pending": t.watermark.Pending(),
+		"timeout": timeout,
+	}).Info("Draining workers")
+	if !t.watermark.WaitForDrain(timeout) {
+		log.WithField("pending", t.watermark.Pending()).Warn("Shutdown timeout reached before draining, pending ops will be replayed on restart")
+	}
+	if t.env.checkpoint {
+		if latest, ok := t.watermark.Low(); ok {
+			if err := t.SaveCheckpoint(latest); err == nil {
+				log.Infof("Saved final checkpoint %+v", latest)
+			}
+		}
+	}
+	t.ReportCounters()
+}
+
 // Serve is the func necessary to start action
 // when using Suture library
 func (t *Tailer) Serve() {
+	metrics.Tailing()
+	admin.Control(t)
 	t.Write()
 	t.Read()
 	t.Report()
@@ -335,6 +461,15 @@ func (t *Tailer) ReportCounters() {
 	}
 }
 
+// Backlog is the number of ops waiting in each collection's channel
+func (t *Tailer) Backlog() map[string]int {
+	backlog := make(map[string]int)
+	for k, c := range t.fan {
+		backlog[k] = len(c)
+	}
+	return backlog
+}
+
 func (t *Tailer) MsLag(epoch int32, nowFunc func() time.Time) int64 {
 	// TODO: use time.Duration instead of this malarky
 	ts := time.Unix(int64(epoch), 0)
@@ -351,6 +486,7 @@ func (t *Tailer) consumer(id string, in <-chan *gtm.Op, overflow chan<- *gtm.Op)
 		workerType = "Generic"
 	}
 	for {
+		t.workers.Set(id, workerIdle)
 		if overflow != nil && len(in) > workerCount {
 			// Siphon off overflow
 			select {
@@ -361,27 +497,27 @@ func (t *Tailer) consumer(id string, in <-chan *gtm.Op, overflow chan<- *gtm.Op)
 		}
 		select {
 		case op := <-in:
+			t.await(id)
 			t.processOp(op, workerType)
-			if t.env.checkpoint {
-				t.checkpoint.Set("latest", t.OpToMoresqlMetadata(op))
-			}
+			t.watermark.Done(op)
 		}
 	}
 }
 
 func (t *Tailer) OpToMoresqlMetadata(op *gtm.Op) MoresqlMetadata {
 	ts, _ := gtm.ParseTimestamp(op.Timestamp)
-	return MoresqlMetadata{AppName: t.env.appName, ProcessedAt: time.Now(), LastEpoch: int64(ts)}
+	token := t.tokens.Get(op)
+	return MoresqlMetadata{AppName: t.env.appName, ProcessedAt: time.Now(), LastEpoch: int64(ts), LastTimestamp: int64(op.Timestamp), ResumeToken: sql.NullString{String: token, Valid: token != ""}}
 }
 
 func (t *Tailer) processOp(op *gtm.Op, workerType string) {
 	collectionName := op.GetCollection()
 	db := op.GetDatabase()
-	st := FullSyncer{Config: t.config}
-	o, c := st.statementFromDbCollection(db, collectionName)
+	c := t.config[db].Collections[collectionName]
 	ts1, ts2 := gtm.ParseTimestamp(op.Timestamp)
 	gtmLag := t.MsLag(ts1, time.Now)
-	logFn := func(s sql.Result, e error) {
+	metrics.Lag(gtmLag)
+	logFn := func(e error) {
 		log.WithFields(log.Fields{
 			"ts":         ts1,
 			"ts2":        ts2,
@@ -393,28 +529,36 @@ func (t *Tailer) processOp(op *gtm.Op, workerType string) {
 			"error":      e,
 		}).Debug(fmt.Sprintf("%s worker processed", workerType))
 	}
-	data := SanitizeData(c.Fields, op)
+	s := NewSinkOp(c, op)
 	switch {
 	case op.IsInsert():
 		t.counters.insert.Incr(1)
-		s, err := t.pg.NamedExec(o.BuildUpsert(), data)
-		logFn(s, err)
+		metrics.Op(op.Namespace, "insert")
+		logFn(t.write(op, s))
 	case op.IsUpdate():
 		t.counters.update.Incr(1)
+		metrics.Op(op.Namespace, "update")
 		// Note we're using upsert here vs update
 		// This imposes a performance penalty but is more robust
 		// in circumstances where an update would fail due to
 		// record missing in PG
-		s, err := t.pg.NamedExec(o.BuildUpsert(), data)
-		logFn(s, err)
+		logFn(t.write(op, s))
 	case op.IsDelete() && t.env.allowDeletes:
 		t.counters.delete.Incr(1)
-		deleteSQL := o.BuildDelete()
-		s, err := t.pg.NamedExec(deleteSQL, data)
-		logFn(s, err)
+		metrics.Op(op.Namespace, "delete")
+		logFn(t.write(op, s))
 	}
 }
 
+// write applies a single op, retrying transient errors and
+// dead lettering the op when it cannot be applied. Exits when
+// neither succeeds, before the op is marked done.
+func (t *Tailer) write(op *gtm.Op, s SinkOp) error {
+	err := WriteOrDeadLetter(t.sink, t.backoff, t.env.appName, op, s)
+	haltIfUnrecorded(op, err)
+	return err
+}
+
 func OpTimestampWrapper(f func() time.Time, ago time.Duration) func(*mgo.Session, *gtm.Options) bson.MongoTimestamp {
 	return func(*mgo.Session, *gtm.Options) bson.MongoTimestamp {
 		now := f()
@@ -433,5 +577,12 @@ func Tail(config Config, pg *sqlx.DB, session *mgo.Session, env Env) {
 	service := NewTailer(config, pg, session, env)
 	supervisor.Add(service)
 	supervisor.ServeBackground()
-	<-service.stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-service.stop:
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+		service.Shutdown(env.shutdownTimeout)
+	}
 }
@@ -44,3 +44,26 @@ func (s *MySuite) TestMsLag(c *C) {
 		c.Check(actual, Equals, int64(tt.out))
 	}
 }
+
+func (s *MySuite) TestNewOptionsFromMongoTimestampKeepsIncrement(c *C) {
+	tail := m.Tailer{}
+	ts := bson.MongoTimestamp(1485144398<<32 | 42)
+	opts, err := tail.NewOptionsFromMongoTimestamp(ts, time.Duration(0))
+	c.Check(err, Equals, nil)
+	c.Check(opts.After(nil, nil), Equals, ts)
+}
+
+func (s *MySuite) TestMetadataPosition(c *C) {
+	var table = []struct {
+		metadata m.MoresqlMetadata
+		position bson.MongoTimestamp
+	}{
+		{m.MoresqlMetadata{LastEpoch: 1485144398, LastTimestamp: 1485144398<<32 | 7}, bson.MongoTimestamp(1485144398<<32 | 7)},
+		// Checkpoints saved before last_timestamp replay their whole second
+		{m.MoresqlMetadata{LastEpoch: 1485144398}, bson.MongoTimestamp(1485144398 << 32)},
+		{m.MoresqlMetadata{}, bson.MongoTimestamp(0)},
+	}
+	for _, t := range table {
+		c.Check(t.metadata.Position(), Equals, t.position)
+	}
+}
@@ -3,16 +3,18 @@ package moresql
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/tidwall/gjson"
 
 	rollus "github.com/heroku/rollrus"
 	"github.com/rwynn/gtm"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func FetchEnvsAndFlags() (e Env) {
@@ -23,11 +25,24 @@ func FetchEnvsAndFlags() (e Env) {
 	var p = *flag.String("postgres-url", "", "`POSTGRES_URL` aka connection string")
 	flag.StringVar(&e.configFile, "config-file", "moresql.json", "Configuration file to use")
 	flag.BoolVar(&e.sync, "full-sync", false, "Run full sync for each db.collection in config")
+	flag.StringVar(&e.fullSyncCollections, "full-sync-collections", "", "Comma separated db.collection keys to limit -full-sync to")
+	flag.StringVar(&e.fullSyncFilter, "full-sync-filter", "", `JSON object of db.collection keys to Mongo queries (extended JSON) limiting the documents -full-sync copies, ie {"db.users": {"active": true}}`)
+	flag.IntVar(&e.fullSyncReaders, "full-sync-readers", 4, "Concurrent Mongo cursors used by -full-sync, shared across collections")
+	flag.IntVar(&e.fullSyncPartitions, "full-sync-partitions", 8, "Number of _id ranges each collection is split into for -full-sync")
+	flag.BoolVar(&e.bulkCopy, "bulk-copy", false, "With -full-sync, load rows using COPY into a staging table merged with one upsert per chunk. Much faster for initial loads")
+	flag.BoolVar(&e.fullSyncStatus, "full-sync-status", false, "Print the progress of the current or last full sync and exit")
 	flag.BoolVar(&e.allowDeletes, "allow-deletes", true, "Allow deletes to propagate from Mongo -> PG")
+	flag.BoolVar(&e.bootstrap, "bootstrap", false, "Record the oplog position, run a full sync, then tail from that position")
+	flag.BoolVar(&e.verify, "verify", false, "Compare each configured collection with its Postgres table, report differing _ids and exit")
+	flag.BoolVar(&e.verifyFix, "verify-fix", false, "With -verify, re-sync documents which differ and delete rows missing from Mongo")
 	flag.BoolVar(&e.tail, "tail", false, "Tail mongodb for each db.collection in config")
 	flag.StringVar(&e.SSLCert, "ssl-cert", "", "SSL PEM cert for Mongodb")
 	flag.StringVar(&e.appName, "app-name", "moresql", "AppName used in Checkpoint table")
-	flag.BoolVar(&e.monitor, "enable-monitor", false, "Run expvarmon endpoint")
+	flag.BoolVar(&e.monitor, "enable-monitor", false, "Serve expvar at /debug/vars and Prometheus metrics at /metrics")
+	flag.StringVar(&e.monitorAddr, "monitor-addr", ":1234", "Listen address for -enable-monitor")
+	flag.DurationVar(&e.healthMaxLag, "health-max-lag", time.Duration(5*time.Minute), "/readyz fails when the replication lag of the last op exceeds this, 0 disables")
+	flag.DurationVar(&e.healthMaxIdle, "health-max-idle", time.Duration(0), "/healthz and /readyz fail when no op has been processed for this long, 0 disables")
+	flag.DurationVar(&e.healthMaxCheckpointAge, "health-max-checkpoint-age", time.Duration(5*time.Minute), "With -checkpoint, /healthz and /readyz fail when no checkpoint has been saved for this long, 0 disables")
 	flag.BoolVar(&e.checkpoint, "checkpoint", false, "Store and restore from checkpoints in PG table: moresql_metadata")
 	flag.BoolVar(&e.createTableSQL, "create-table-sql", false, "Print out the necessary SQL for creating metadata table required for checkpointing")
 	flag.BoolVar(&e.validatePostgres, "validate", false, "Validate the postgres table structures and exit")
@@ -35,15 +50,31 @@ func FetchEnvsAndFlags() (e Env) {
 	flag.StringVar(&e.memprofile, "memprofile", "", "Profile memory usage. Supply filename for output of memory usage")
 	defaultDuration := time.Duration(0 * time.Second)
 	flag.DurationVar(&e.replayDuration, "replay-duration", defaultDuration, "Last x to replay ie '1s', '5m', etc as parsed by Time.ParseDuration. Will be subtracted from time.Now()")
-	flag.Int64Var(&e.replaySecond, "replay-second", 0, "Replay a specific epoch second of the oplog and forward from there.")
+	flag.StringVar(&e.replaySecond, "replay-second", "", "Replay a specific epoch second of the oplog and forward from there. Use seconds:increment to start at a specific op within that second.")
+	flag.StringVar(&e.source, "source", sourceOplog, "Where tail reads operations from: oplog or changestream (MongoDB 4.0+, checkpoints store a resume token)")
+	flag.IntVar(&e.batchSize, "batch-size", 1, "Max ops each tail worker applies per transaction, ie 500. 1 applies each op on its own")
+	flag.DurationVar(&e.batchDuration, "batch-duration", time.Duration(250*time.Millisecond), "Max time a tail worker waits to fill a batch before applying it")
+	flag.IntVar(&e.retryAttempts, "retry-attempts", 20, "Attempts made at a write failing with a transient error before it is written to moresql_dead_letters, the default covers an outage of about 6 minutes")
+	flag.DurationVar(&e.retryMaxBackoff, "retry-max-backoff", time.Duration(30*time.Second), "Upper bound on the exponential backoff between write attempts")
+	flag.BoolVar(&e.replayDeadLetters, "replay-dead-letters", false, "Reapply ops stored in moresql_dead_letters using the current config, then exit")
+	flag.StringVar(&e.metadataSchema, "metadata-schema", "public", "Postgres schema holding moresql_metadata and moresql_dead_letters")
+	flag.BoolVar(&e.migrate, "migrate", false, "Create missing tables, columns and _id unique indexes in one transaction. Exits unless combined with -tail, -full-sync or -bootstrap")
+	flag.BoolVar(&e.migrateDryRun, "migrate-dry-run", false, "Print the SQL -migrate would apply without applying it")
+	flag.DurationVar(&e.shutdownTimeout, "shutdown-timeout", time.Duration(20*time.Second), "On SIGTERM/SIGINT, how long tail waits for buffered ops to be applied before saving a final checkpoint and exiting")
 	flag.BoolVar(&e.SSLInsecureSkipVerify, "ssl-insecure-skip-verify", false, "Skip verification of Mongo SSL certificate ala sslAllowInvalidCertificates")
 	flag.Parse()
 	e.reportingToken = os.Getenv("ERROR_REPORTING_TOKEN")
+	e.adminToken = os.Getenv("ADMIN_TOKEN")
 	e.appEnvironment = os.Getenv("APP_ENV")
 	if e.appEnvironment == "" {
 		e.appEnvironment = "production"
 	}
-	if e.replayDuration != defaultDuration && e.replaySecond != 0 {
+	replayTimestamp, err := ParseReplayTimestamp(e.replaySecond)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.replayTimestamp = replayTimestamp
+	if e.replayDuration != defaultDuration && e.replayTimestamp != 0 {
 		e.replayOplog = true
 	} else {
 		e.replayOplog = false
@@ -75,6 +106,32 @@ func FetchEnvsAndFlags() (e Env) {
 	return
 }
 
+// ParseReplayTimestamp converts -replay-second into the oplog position to tail after.
+// Accepts seconds or seconds:increment. Both forms include the named op, so seconds
+// alone replays the entire second.
+func ParseReplayTimestamp(s string) (bson.MongoTimestamp, error) {
+	if s == "" {
+		return bson.MongoTimestamp(0), nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return bson.MongoTimestamp(0), fmt.Errorf("Invalid seconds in replay-second %s: %s", s, err)
+	}
+	var increment uint64
+	if len(parts) == 2 {
+		increment, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return bson.MongoTimestamp(0), fmt.Errorf("Invalid increment in replay-second %s: %s", s, err)
+		}
+		if increment > 0 {
+			// Tailing is exclusive, so start just before the requested op
+			increment--
+		}
+	}
+	return bson.MongoTimestamp(seconds<<32 | increment), nil
+}
+
 func SetupLogger(env Env) {
 	// Alter logging pattern for heroku
 	log.SetOutput(os.Stdout)
@@ -117,53 +174,78 @@ func isActionableOperation(filters ...func() bool) bool {
 
 // SanitizeData handles type inconsistency between mongo and pg
 // and flattens the data from a potentially nested data struct
-// into a flattened struct using gjson.
+// into a flattened struct using ExtractPath. Values are converted
+// according to their field's Mongo type, see ConvertMongoType.
 func SanitizeData(pgFields Fields, op *gtm.Op) map[string]interface{} {
 	if !IsInsertUpdateDelete(op) {
 		return make(map[string]interface{})
 	}
 
-	newData, err := json.Marshal(op.Data)
-	parsed := gjson.ParseBytes(newData)
-	output := make(map[string]interface{})
-	if err != nil {
-		log.Errorf("Failed to marshal op.Data into json %s", err.Error())
-	}
-
-	for k, v := range pgFields {
-		// Dot notation extraction
-		maybe := parsed.Get(k)
-		if !maybe.Exists() {
-			// Fill with nils to ensure that NamedExec works
-			output[v.Postgres.Name] = nil
-		} else {
-			// Sanitize the Value field when it's a map
-			value := maybe.Value()
-			if _, ok := maybe.Value().(map[string]interface{}); ok {
-				// Marshal Objects using JSON
-				b, _ := json.Marshal(value)
-				output[v.Postgres.Name] = string(b)
-			} else if _, ok := maybe.Value().([]interface{}); ok {
-				// Marshal Arrays using JSON
-				b, _ := json.Marshal(value)
-				output[v.Postgres.Name] = string(b)
-			} else {
-				output[v.Postgres.Name] = value
-			}
-		}
-	}
+	output := sanitizeDocument(pgFields, op.Data)
 
 	// Normalize data map to always include the Id with conversion
 	// Required for delete actions that have a missing _id field in
 	// op.Data. Must occur after the preceeding iterative block
 	// in order to avoid being overwritten with nil.
 	if op.Id != nil {
-		output["_id"] = op.Id
+		output["_id"] = NormalizeBSON(op.Id)
 	}
 
 	return output
 }
 
+// sanitizeDocument extracts pgFields from a document as decoded from BSON,
+// ExtractPath normalizes each value extracted
+func sanitizeDocument(pgFields Fields, doc interface{}) map[string]interface{} {
+	output := make(map[string]interface{})
+	var env map[string]interface{}
+	for k, v := range pgFields {
+		if v.isExtraProps() {
+			// Filled by sanitizeCollection
+			continue
+		}
+		var value interface{}
+		var ok bool
+		if v.isComputed() {
+			if env == nil {
+				env = exprEnv(doc)
+			}
+			var err error
+			if value, err = evaluate(v.Mongo.Name, env); err != nil {
+				entry := log.WithFields(log.Fields{"field": k, "expr": v.Mongo.Name, "error": err})
+				// Only the first failure per field is a warning, as
+				// every document missing a path fails the same way
+				if metrics.ExpressionError(k) == 1 {
+					entry.Warn("Unable to evaluate expression, further failures are logged at debug")
+				} else {
+					entry.Debug("Unable to evaluate expression")
+				}
+			}
+			ok = value != nil
+		} else {
+			// Dot notation extraction
+			value, ok = ExtractPath(doc, k)
+		}
+		if !ok {
+			// Fill with nils to ensure that NamedExec works
+			output[v.Postgres.Name] = nil
+			continue
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			// Marshal Objects and Arrays using JSON
+			b, err := json.Marshal(value)
+			if err != nil {
+				log.Errorf("Failed to marshal %s into json %s", k, err.Error())
+			}
+			output[v.Postgres.Name] = string(b)
+		default:
+			output[v.Postgres.Name] = ConvertMongoType(v.Mongo.Type, value)
+		}
+	}
+	return output
+}
+
 func createFanKey(db string, collection string) string {
 	return db + "." + collection
 }
@@ -187,6 +269,12 @@ func EnsureOpHasAllFields(op *gtm.Op, keysToEnsure []string) *gtm.Op {
 	return op
 }
 
+// postgresOnly is true when the requested commands need only Postgres and
+// no mode that continues afterwards was given
+func (e *Env) postgresOnly() bool {
+	return (e.migrate || e.migrateDryRun || e.fullSyncStatus) && !(e.sync || e.tail || e.bootstrap || e.verify || e.replayDeadLetters)
+}
+
 func ExitUnlessValidEnv(e Env) {
 	if e.validatePostgres {
 		return
@@ -194,7 +282,15 @@ func ExitUnlessValidEnv(e Env) {
 
 	if e.createTableSQL {
 		c := Commands{}
-		c.CreateTableSQL()
+		c.CreateTableSQL(e.metadataSchema)
+	}
+	if e.postgresOnly() {
+		if e.urls.postgres == "" {
+			log.Warnf("Missing required variable. POSTGRES_URL must be set.")
+			flag.Usage()
+			os.Exit(1)
+		}
+		return
 	}
 	if e.urls.mongo == "" || e.urls.postgres == "" {
 		log.Warnf(`Missing required variable. Both MONGO_URL and POSTGRES_URL must be set.
@@ -202,7 +298,32 @@ func ExitUnlessValidEnv(e Env) {
 		flag.Usage()
 		os.Exit(1)
 	}
-	if !(e.sync || e.tail) {
+	if !(e.sync || e.tail || e.bootstrap || e.verify || e.replayDeadLetters) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if e.source != sourceOplog && e.source != sourceChangeStream {
+		log.Warnf("Invalid -source %s, choose from %s or %s", e.source, sourceOplog, sourceChangeStream)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if (e.sync || e.bootstrap) && (e.fullSyncReaders < 1 || e.fullSyncPartitions < 1) {
+		log.Warnf("Invalid -full-sync-readers %d or -full-sync-partitions %d, both must be at least 1", e.fullSyncReaders, e.fullSyncPartitions)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if e.verifyFix && !e.verify {
+		log.Warnf("-verify-fix requires -verify")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if e.bulkCopy && !(e.sync || e.bootstrap) {
+		log.Warnf("-bulk-copy requires -full-sync or -bootstrap")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if e.batchSize > 1 && e.batchDuration <= 0 {
+		log.Warnf("Invalid -batch-duration %s, must be positive when batching", e.batchDuration)
 		flag.Usage()
 		os.Exit(1)
 	}
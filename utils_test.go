@@ -117,3 +117,24 @@ func (s *MySuite) TestIsInsertUpdateDelete(c *C) {
 // func (s *MySuite) TestCreateFanKey(c *C){
 
 // }
+
+func (s *MySuite) TestParseReplayTimestamp(c *C) {
+	var table = []struct {
+		in  string
+		out bson.MongoTimestamp
+		ok  bool
+	}{
+		{"", bson.MongoTimestamp(0), true},
+		{"1485144398", bson.MongoTimestamp(1485144398 << 32), true},
+		{"1485144398:1", bson.MongoTimestamp(1485144398 << 32), true},
+		{"1485144398:42", bson.MongoTimestamp(1485144398<<32 | 41), true},
+		{"1485144398:", bson.MongoTimestamp(0), false},
+		{"abc", bson.MongoTimestamp(0), false},
+		{"-1", bson.MongoTimestamp(0), false},
+	}
+	for _, t := range table {
+		actual, err := m.ParseReplayTimestamp(t.in)
+		c.Check(actual, Equals, t.out)
+		c.Check(err == nil, Equals, t.ok)
+	}
+}
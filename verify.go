@@ -0,0 +1,289 @@
+package moresql
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/orcaman/concurrent-map"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// verifyChunkSize is the number of documents compared per digest, fewer
+// for tables with too many columns to bind that many documents
+const verifyChunkSize = 1000
+
+const (
+	mismatchMissingInPostgres = "missing_in_postgres"
+	mismatchMissingInMongo    = "missing_in_mongo"
+	mismatchDifferent         = "different"
+)
+
+// Mismatch is a document which differs between Mongo and Postgres
+type Mismatch struct {
+	Namespace string
+	Id        string
+	Kind      string
+}
+
+// VerifyReport summarizes the comparison of one collection
+type VerifyReport struct {
+	Namespace     string
+	MongoCount    int
+	PostgresCount int
+	Chunks        int
+	ChunksDiffer  int
+	Mismatches    []Mismatch
+	Fixed         int
+}
+
+type verifyRow struct {
+	N   int    `db:"n"`
+	Id  string `db:"id"`
+	Doc string `db:"doc"`
+}
+
+type verifyDigest struct {
+	Count  int    `db:"count"`
+	Digest string `db:"digest"`
+}
+
+// Verify compares every configured collection, or those given with
+// -full-sync-collections, with Postgres and exits non zero on differences
+func Verify(config Config, pg *sqlx.DB, mongo *mgo.Session, env Env) {
+	selection, err := ParseSyncSelection(config, env.fullSyncCollections, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	z := NewSynchronizer(config, pg, mongo, env)
+	z.selection = selection
+	z.appName = env.appName
+	z.backoff = NewBackoff(env.retryAttempts, env.retryMaxBackoff)
+	tables := z.buildTables()
+	var differences int
+	for _, t := range z.targets() {
+		report, err := z.verifyCollection(pg, t, env.verifyFix, &tables)
+		if err != nil {
+			log.Errorf("Unable to verify %s: %s", createFanKey(t.db, t.name), err)
+			differences++
+			continue
+		}
+		for _, m := range report.Mismatches {
+			log.WithFields(log.Fields{
+				"collection": m.Namespace,
+				"id":         m.Id,
+				"kind":       m.Kind,
+			}).Warn("Document differs")
+		}
+		log.WithFields(log.Fields{
+			"collection":     report.Namespace,
+			"mongo_count":    report.MongoCount,
+			"postgres_count": report.PostgresCount,
+			"chunks":         report.Chunks,
+			"chunks_differ":  report.ChunksDiffer,
+			"mismatches":     len(report.Mismatches),
+			"fixed":          report.Fixed,
+		}).Info("Verified collection")
+		differences += len(report.Mismatches) - report.Fixed
+	}
+	z.Output.Close()
+	if differences > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// verifyCollection walks the collection in _id order comparing each chunk of
+// documents with a digest Postgres computes over the rows in the chunk's _id
+// range. Only chunks whose digests differ are compared document by document.
+// Rows left in Postgres without a document are then found by checking
+// Postgres ids against Mongo.
+func (z *FullSyncer) verifyCollection(pg *sqlx.DB, t syncTarget, fix bool, tables *cmap.ConcurrentMap) (VerifyReport, error) {
+	key := createFanKey(t.db, t.name)
+	coll := z.Config[t.db].Collections[t.name]
+	o := Statement{coll}
+	report := VerifyReport{Namespace: key}
+	session := z.Mongo.Copy()
+	defer session.Close()
+	mongo := session.DB(t.db).C(t.name)
+
+	var err error
+	if report.MongoCount, err = mongo.Count(); err != nil {
+		return report, err
+	}
+	if err = pg.Get(&report.PostgresCount, o.BuildCount()); err != nil {
+		return report, err
+	}
+
+	size := verifyChunkSize
+	if limit := o.BatchRowLimit(); limit < size {
+		size = limit
+	}
+	var matched int
+	var chunk []DBResult
+	compare := func(upper interface{}) error {
+		n, err := z.verifyChunk(pg, o, key, chunk, upper, fix, tables, &report)
+		matched += n
+		chunk = nil
+		return err
+	}
+	iter := mongo.Find(nil).Sort("_id").Iter()
+	var doc map[string]interface{}
+	for iter.Next(&doc) {
+		e := DBResult{MongoDB: t.db, Collection: t.name, Data: doc}
+		if len(chunk) >= size {
+			// The chunk's range ends before the next document
+			if err := compare(verifyData(o, e)[o.id().Postgres.Name]); err != nil {
+				iter.Close()
+				return report, err
+			}
+		}
+		chunk = append(chunk, e)
+		doc = make(map[string]interface{})
+	}
+	if err := iter.Close(); err != nil {
+		return report, err
+	}
+	if len(chunk) > 0 {
+		if err := compare(nil); err != nil {
+			return report, err
+		}
+	}
+
+	// Every Postgres row not matched to a document is extra
+	if report.PostgresCount > matched {
+		_, err := z.findOrphans(pg, t, coll, func(id string, mapped bool) {
+			report.Mismatches = append(report.Mismatches, Mismatch{Namespace: key, Id: id, Kind: mismatchMissingInMongo})
+			if !fix {
+				return
+			}
+			if !mapped {
+				log.WithFields(log.Fields{"collection": key, "id": id}).Warn("Not deleting row missing from Mongo, its id cannot be mapped back to a Mongo _id")
+				return
+			}
+			data := map[string]interface{}{o.id().Mongo.Name: id}
+			if err := z.backoff.Retry(func() error { return z.Output.Delete(coll, data) }); err != nil {
+				log.WithFields(log.Fields{"collection": key, "id": id, "error": err}).Error("Unable to delete row missing from Mongo")
+				return
+			}
+			report.Fixed++
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// verifyData sanitizes a copy of e's document as it is written to Postgres,
+// sanitizing fills missing fields in e.Data which is kept for fixes
+func verifyData(o Statement, e DBResult) map[string]interface{} {
+	data := make(map[string]interface{}, len(e.Data))
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	return BuildOpFromMgo(o.mongoFields(), DBResult{Data: data}, o.Collection).Data
+}
+
+// verifyChunk compares documents with the Postgres rows from the chunk's
+// first _id up to upper, or to the end of the table when upper is nil.
+// Both are digested by Postgres, the documents cast to the column types
+// as they are on write. It returns the number of rows matched to documents.
+func (z *FullSyncer) verifyChunk(pg *sqlx.DB, o Statement, key string, chunk []DBResult, upper interface{}, fix bool, tables *cmap.ConcurrentMap, report *VerifyReport) (int, error) {
+	report.Chunks++
+	var rows []map[string]interface{}
+	var bounds []interface{}
+	for i, e := range chunk {
+		data := verifyData(o, e)
+		if i == 0 {
+			bounds = append(bounds, data[o.id().Postgres.Name])
+		}
+		rows = append(rows, data)
+	}
+	if upper != nil {
+		bounds = append(bounds, upper)
+	}
+	var digest, expected verifyDigest
+	if err := pg.Get(&digest, o.BuildVerifyRange(upper != nil), bounds...); err != nil {
+		return 0, err
+	}
+	err := pg.Get(&expected, o.BuildVerifyDocuments(len(rows)), o.BatchUpsertArgs(rows)...)
+	if IsTransientError(err) {
+		return 0, err
+	}
+	// Otherwise an error is a document Postgres rejects, which cannot match
+	if err == nil && digest == expected {
+		return digest.Count, nil
+	}
+
+	report.ChunksDiffer++
+	docs, err := renderDocuments(pg, o, chunk, rows)
+	if err != nil {
+		return 0, err
+	}
+	var args []interface{}
+	for _, d := range docs {
+		args = append(args, d.Id)
+	}
+	var stored []verifyRow
+	if err := pg.Select(&stored, o.BuildVerifyRows(len(args)), args...); err != nil {
+		return 0, err
+	}
+	pgRows := make(map[string]string)
+	for _, r := range stored {
+		pgRows[r.Id] = r.Doc
+	}
+	for i, d := range docs {
+		pgRow, ok := pgRows[d.Id]
+		kind := ""
+		switch {
+		case !ok:
+			kind = mismatchMissingInPostgres
+		case pgRow != d.Doc:
+			kind = mismatchDifferent
+			log.WithFields(log.Fields{"collection": key, "id": d.Id, "mongo": d.Doc, "postgres": pgRow}).Debug("Document differs")
+		default:
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, Mismatch{Namespace: key, Id: d.Id, Kind: kind})
+		if fix {
+			if err := z.writeResult(chunk[i], tables); err != nil {
+				log.WithFields(log.Fields{"collection": key, "id": d.Id, "error": err}).Error("Unable to re-sync document")
+				continue
+			}
+			report.Fixed++
+		}
+	}
+	return len(stored), nil
+}
+
+// renderDocuments renders the sanitized rows of chunk as BuildVerifyRows
+// renders stored rows, in chunk order. Documents Postgres rejects keep their
+// formatted _id and an empty doc, which never matches a stored row.
+func renderDocuments(pg *sqlx.DB, o Statement, chunk []DBResult, rows []map[string]interface{}) ([]verifyRow, error) {
+	docs := make([]verifyRow, len(rows))
+	var rendered []verifyRow
+	err := pg.Select(&rendered, o.BuildVerifyDocumentRows(len(rows)), o.BatchUpsertArgs(rows)...)
+	if err == nil {
+		for _, r := range rendered {
+			docs[r.N] = r
+		}
+		return docs, nil
+	}
+	if IsTransientError(err) {
+		return nil, err
+	}
+	// Render one at a time to find the documents Postgres rejects
+	for i, data := range rows {
+		err := pg.Get(&docs[i], o.BuildVerifyDocumentRows(1), o.BatchUpsertArgs([]map[string]interface{}{data})...)
+		if IsTransientError(err) {
+			return nil, err
+		}
+		if err != nil {
+			id := FormatMongoId(chunk[i].Data["_id"])
+			log.WithFields(log.Fields{"id": id, "error": err}).Debug("Document rejected by Postgres")
+			docs[i] = verifyRow{Id: id}
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,28 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestBuildVerifyDocuments(c *C) {
+	collection := m.Collection{Name: "users", PgTable: "users", Fields: m.Fields{
+		"_id":        m.Field{m.Mongo{"_id", "id"}, m.Postgres{"id", "text"}},
+		"created_at": m.Field{m.Mongo{"created_at", "date"}, m.Postgres{"created_at", "timestamp with time zone"}},
+		"tags":       m.Field{m.Mongo{"tags", "object"}, m.Postgres{"tags", ""}},
+	}}
+	o := m.Statement{collection}
+	row := `CASE WHEN "id" IS NULL THEN 'N' ELSE 'V' || length("id"::text) || ':' || "id"::text END || ` +
+		`CASE WHEN "created_at" IS NULL THEN 'N' ELSE 'V' || length("created_at"::text) || ':' || "created_at"::text END || ` +
+		`CASE WHEN "tags" IS NULL THEN 'N' ELSE 'V' || length("tags"::text) || ':' || "tags"::text END`
+	// Cast to the column types so documents render as the stored rows do
+	values := `(VALUES (0, $1::text, $2::timestamp with time zone, $3), (1, $4::text, $5::timestamp with time zone, $6)) AS v(moresql_row, "id", "created_at", "tags")`
+	c.Check(o.BuildVerifyDocuments(2), Equals, `SELECT count(*) AS count, coalesce(md5(string_agg(row, '' ORDER BY row COLLATE "C")), '') AS digest FROM (SELECT `+row+` AS row FROM `+values+`) AS rows;`)
+	c.Check(o.BuildVerifyDocumentRows(2), Equals, `SELECT moresql_row AS n, "id"::text AS id, `+row+` AS doc FROM `+values+`;`)
+
+	args := o.BatchUpsertArgs([]map[string]interface{}{
+		{"id": "a", "created_at": nil, "tags": `["x"]`},
+		{"id": "b", "created_at": nil, "tags": nil},
+	})
+	c.Check(args, DeepEquals, []interface{}{"a", nil, `["x"]`, "b", nil, nil})
+}
@@ -0,0 +1,116 @@
+package moresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+)
+
+type watermarkEntry struct {
+	metadata MoresqlMetadata
+	done     bool
+}
+
+// Watermark tracks every op handed to workers in the order it was read
+// and reports the low-water mark: the position of the newest op for which
+// it and every op read before it have been applied. Resuming from the
+// low-water mark never skips an op, regardless of which worker finishes first.
+type Watermark struct {
+	sync.Mutex
+	entries []*watermarkEntry
+	byOp    map[*gtm.Op]*watermarkEntry
+	low     *MoresqlMetadata
+}
+
+func NewWatermark() *Watermark {
+	return &Watermark{byOp: make(map[*gtm.Op]*watermarkEntry)}
+}
+
+// Add registers op as in flight at position m. Must be called in read order.
+func (w *Watermark) Add(op *gtm.Op, m MoresqlMetadata) {
+	w.Lock()
+	defer w.Unlock()
+	e := &watermarkEntry{metadata: m}
+	w.entries = append(w.entries, e)
+	w.byOp[op] = e
+}
+
+// Done marks ops as applied and advances the low-water mark
+func (w *Watermark) Done(ops ...*gtm.Op) {
+	w.Lock()
+	defer w.Unlock()
+	for _, op := range ops {
+		if e, ok := w.byOp[op]; ok {
+			e.done = true
+			delete(w.byOp, op)
+		}
+	}
+	for len(w.entries) > 0 && w.entries[0].done {
+		w.low = &w.entries[0].metadata
+		w.entries = w.entries[1:]
+	}
+}
+
+// Low returns the current low-water mark, false when nothing has been applied
+func (w *Watermark) Low() (MoresqlMetadata, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.low == nil {
+		return MoresqlMetadata{}, false
+	}
+	return w.stamp(*w.low), true
+}
+
+// LowWith returns the low-water mark as it will be once ops are applied,
+// without marking them done. Used to write a checkpoint in the same
+// transaction as ops so that the two commit together.
+func (w *Watermark) LowWith(ops []*gtm.Op) (MoresqlMetadata, bool) {
+	w.Lock()
+	defer w.Unlock()
+	pending := make(map[*watermarkEntry]bool)
+	for _, op := range ops {
+		if e, ok := w.byOp[op]; ok {
+			pending[e] = true
+		}
+	}
+	low := w.low
+	for _, e := range w.entries {
+		if !e.done && !pending[e] {
+			break
+		}
+		low = &e.metadata
+	}
+	if low == nil {
+		return MoresqlMetadata{}, false
+	}
+	return w.stamp(*low), true
+}
+
+// Pending is the number of ops read but not yet at or below the low-water mark
+func (w *Watermark) Pending() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.entries)
+}
+
+func (w *Watermark) stamp(m MoresqlMetadata) MoresqlMetadata {
+	m.ProcessedAt = time.Now()
+	return m
+}
+
+// watermarkPollFrequency is how often WaitForDrain checks for pending ops
+const watermarkPollFrequency = time.Duration(100) * time.Millisecond
+
+// WaitForDrain blocks until every op added has been applied or timeout
+// passes. Returns false when ops were still pending at the deadline.
+func (w *Watermark) WaitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for w.Pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(watermarkPollFrequency)
+	}
+	return true
+}
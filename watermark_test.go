@@ -0,0 +1,63 @@
+package moresql_test
+
+import (
+	"time"
+
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWatermarkAdvancesOnlyOverAppliedPrefix(c *C) {
+	w := m.NewWatermark()
+	ops := []*gtm.Op{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+	for i, op := range ops {
+		w.Add(op, m.MoresqlMetadata{LastEpoch: int64(i + 1)})
+	}
+	_, ok := w.Low()
+	c.Check(ok, Equals, false)
+
+	// A slower worker still holds the first op
+	w.Done(ops[1], ops[2])
+	_, ok = w.Low()
+	c.Check(ok, Equals, false)
+	c.Check(w.Pending(), Equals, 3)
+
+	w.Done(ops[0])
+	low, ok := w.Low()
+	c.Check(ok, Equals, true)
+	c.Check(low.LastEpoch, Equals, int64(3))
+	c.Check(w.Pending(), Equals, 0)
+}
+
+func (s *MySuite) TestWatermarkLowWith(c *C) {
+	w := m.NewWatermark()
+	ops := []*gtm.Op{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+	for i, op := range ops {
+		w.Add(op, m.MoresqlMetadata{LastEpoch: int64(i + 1)})
+	}
+	w.Done(ops[1])
+
+	low, ok := w.LowWith([]*gtm.Op{ops[0]})
+	c.Check(ok, Equals, true)
+	c.Check(low.LastEpoch, Equals, int64(2))
+
+	// LowWith does not mark anything as done
+	_, ok = w.Low()
+	c.Check(ok, Equals, false)
+
+	_, ok = w.LowWith([]*gtm.Op{ops[2]})
+	c.Check(ok, Equals, false)
+}
+
+func (s *MySuite) TestWatermarkWaitForDrain(c *C) {
+	w := m.NewWatermark()
+	c.Check(w.WaitForDrain(0), Equals, true)
+
+	op := &gtm.Op{Id: "a"}
+	w.Add(op, m.MoresqlMetadata{LastEpoch: 1})
+	c.Check(w.WaitForDrain(10*time.Millisecond), Equals, false)
+
+	go w.Done(op)
+	c.Check(w.WaitForDrain(time.Second), Equals, true)
+}